@@ -3,17 +3,189 @@ package acpl
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"math"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/notnil/chess"
 )
 
+type Options struct {
+	// MinPlies excludes games shorter than this many plies in total
+	MinPlies int
+	// MinEvaluatedPlies excludes games where fewer of the player's plies could be scored
+	MinEvaluatedPlies int
+	// MinRankedPlies ranks games where fewer of the player's plies could be scored below all others,
+	// so that a few lucky moves cannot top the list. Unlike MinPlies and MinEvaluatedPlies, such games
+	// are still returned and count towards summaries. A game must pass all three to rank normally.
+	MinRankedPlies int
+	// IgnoreResignationLoss excludes the player's final move when they resigned in a clearly lost position
+	IgnoreResignationLoss bool
+	// CriticalOnly restricts ACPL to moves losing more than CriticalThreshold centipawns
+	CriticalOnly      bool
+	CriticalThreshold float64
+	// ContestedOnly leaves out moves played in a decided position, one whose eval before the move was
+	// beyond DecidedThreshold centipawns either way, wherever in the game they come. Such moves still
+	// update the eval baseline.
+	ContestedOnly    bool
+	DecidedThreshold float64
+	// ExcludeUnchanged leaves out moves after which the eval did not move at all. Such moves are often
+	// forced or trivial, and counting them as perfect lowers ACPL; leaving them out makes long games with
+	// many quiet moves look worse than with plain ACPL.
+	ExcludeUnchanged bool
+	// NoiseFloor treats losses below this many centipawns as no loss at all, as engine evals vary by
+	// that much between runs. Such moves still count towards ACPL, as perfect moves.
+	NoiseFloor float64
+	// ExcludeRecaptures leaves out recaptures, see IsRecapture. They are usually forced, so finding them
+	// says little about accuracy; this is a heuristic, as a recapture can also be the wrong choice.
+	ExcludeRecaptures bool
+	// ExcludePremoves leaves out the player's moves that took less than PremoveThreshold, see MoveTimes.
+	// In bullet these are almost always premoves, made before seeing the opponent's move.
+	ExcludePremoves bool
+	// MaterialWeighting scales each loss down by the material imbalance before the move, see MaterialWeight
+	MaterialWeighting bool
+	// EvaluateFirstMove measures the first move of the game against StartingEval, in centipawns from
+	// White's perspective. Otherwise it has no baseline and never counts, as Lichess does not evaluate
+	// the initial position. Book moves say little about accuracy, hence the toggle.
+	EvaluateFirstMove bool
+	StartingEval      float64
+	// SkipBook leaves out the losses of moves still in the opening book, see BookPlies, so that the first
+	// counted move is the first one out of book. Games whose book depth is unknown skip FallbackBookPlies.
+	SkipBook          bool
+	FallbackBookPlies int
+	// ConvertingFrom, when positive, only counts the player's moves once the eval first reached this many
+	// centipawns in their favour, to measure how cleanly they converted. Games never that far ahead have no
+	// losses and so are not ranked.
+	ConvertingFrom float64
+	// MaxPlies stops counting losses after this many plies of the game, when positive
+	MaxPlies int
+	// FromMove, when above 1, only counts losses from White's move of that number onward, e.g. to study
+	// play after a known opening. The eval before that move is the baseline. Games that end before it are
+	// not ranked.
+	FromMove int
+	// TheoryDepth sets each result's TheoryPlies, see TheoryPlies. It is optional as the opening book
+	// takes a while to load.
+	TheoryDepth bool
+	// SkipLastPlies leaves out the losses of the game's final plies, when positive, as technique in a
+	// decided position, such as mating with a queen, is near-perfect and flatters accuracy
+	SkipLastPlies int
+	// Filters must all keep a game for it to be ranked
+	Filters []Filter
+	// Extractor reads evals from move comments, defaulting to LichessExtractor
+	Extractor EvalExtractor
+	// Provider evaluates positions of games without any eval annotation, when set
+	Provider EvalProvider
+	// WinSteepness is the slope WinPercent turns evals into winning chances with, for Accuracy and
+	// ExpectedPointsLost, defaulting to DefaultWinSteepness
+	WinSteepness float64
+	// SortBy selects the ranking score, see the Sort constants
+	SortBy string
+	// ConsistencyWeight is k in the SortConsistency score
+	ConsistencyWeight float64
+	// ExcludeSuspect leaves out games whose evals look corrupted, see Suspect. Otherwise they are ranked
+	// and flagged.
+	ExcludeSuspect bool
+	// StrictPGN reports the games that could not be parsed, see Exclusions.Rejected. Otherwise they are
+	// silently skipped.
+	StrictPGN bool
+}
+
+const (
+	// SortACPL ranks games by plain ACPL
+	SortACPL = "acpl"
+	// SortLengthAdjusted ranks games by ACPL / log2(plies), so that of two games with the same ACPL
+	// the longer one ranks higher. Doubling the length of a game divides its score by one more.
+	SortLengthAdjusted = "length"
+	// SortConsistency ranks games by ACPL + k * the standard deviation of the losses, so that of two
+	// games with the same ACPL the one without a standout mistake ranks higher. k is ConsistencyWeight.
+	SortConsistency = "consistency"
+	// SortGap ranks games by ACPL minus the opponent's ACPL, so that the most one-sided games come first.
+	// Games where the opponent's ACPL cannot be computed are left out.
+	SortGap = "gap"
+	// SortBlunders ranks games by their number of blunders, then by ACPL, so that clean games with a few
+	// inaccuracies come before accurate games spoiled by a single blunder
+	SortBlunders = "blunders"
+	// SortSharpness ranks games by SharpnessAdjustedACPL, so that of two games with the same ACPL the one
+	// whose eval swung more, and so was harder to play accurately, ranks higher
+	SortSharpness = "sharpness"
+)
+
+// sharpnessScale is the eval volatility, in centipawns, at which SharpnessAdjustedACPL halves ACPL
+const sharpnessScale = 100.0
+
+// lostThreshold is the eval, in centipawns against the player, beyond which a position is considered clearly lost
+const lostThreshold = 300
+
+// PlyLoss is the centipawn loss of one of the player's evaluated moves
+type PlyLoss struct {
+	// Ply indexes game.Moves()
+	Ply  int
+	Loss float64
+	// Before and After are the evals around the move, in centipawns from the player's perspective
+	Before float64
+	After  float64
+	// Recapture is whether the move recaptured on the square of the opponent's capture, see IsRecapture
+	Recapture bool
+}
+
+// Loss thresholds in centipawns for classifying moves
+const (
+	InaccuracyThreshold = 50
+	MistakeThreshold    = 100
+	BlunderThreshold    = 300
+)
+
 type GameACPL struct {
 	Game *chess.Game
-	ACPL float64
+	// IsWhite is whether the player had White
+	IsWhite bool
+	ACPL    float64
+	// OpponentACPL is only set when HasOpponentACPL, as the opponent's moves may not all be evaluated
+	OpponentACPL    float64
+	HasOpponentACPL bool
+	// Losses are the player's evaluated moves, and Counted those of them ACPL counts, see countedLosses
+	Losses  []PlyLoss
+	Counted []PlyLoss
+	// TotalLoss and Count are the sum and number of the losses ACPL averages, and StdDev their standard deviation
+	TotalLoss float64
+	Count     int
+	StdDev    float64
+	// Accuracy is the player's Lichess-style accuracy percentage
+	Accuracy float64
+	// ExpectedPointsLost is what the player's moves threw away, see ExpectedPointsLost
+	ExpectedPointsLost float64
+	// Worst is the player's costliest move, only set when HasWorst
+	Worst    PlyLoss
+	HasWorst bool
+	// Lowest is the worst eval the player faced, in centipawns from their perspective, after LowestPly.
+	// They are only set when HasLowest.
+	Lowest    float64
+	LowestPly int
+	HasLowest bool
+	// Score is what games are ranked by, lowest first. It equals ACPL unless Options.SortBy says otherwise.
+	// SortBlunders ranks by Blunders first.
+	Score float64
+	// Blunders is how many of the counted losses reached BlunderThreshold
+	Blunders int
+	// Suspect is why the game's evals look corrupted, or "" when they look plausible
+	Suspect string
+	// TurningPoint is where the game was decided, only set when HasTurningPoint
+	TurningPoint    TurningPoint
+	HasTurningPoint bool
+	// TheoryPlies is how many plies the game followed opening theory, only set when HasTheoryPlies
+	TheoryPlies    int
+	HasTheoryPlies bool
+	// Eligible is whether the game has enough scored plies to rank ahead of those that do not, see
+	// Options.MinRankedPlies
+	Eligible bool
 }
 
 func splitPGN(data []byte, atEOF bool) (advance int, token []byte, err error) {
@@ -33,75 +205,119 @@ func splitPGN(data []byte, atEOF bool) (advance int, token []byte, err error) {
 	return 0, nil, nil
 }
 
-// parse [%eval X] from comment
-func parseEval(comment string) (float64, bool) {
-	const key = "%eval "
-	i := strings.Index(comment, key)
-	if i == -1 {
-		return 0, false
-	}
-
-	s := comment[i+len(key):]
+// PlayerColor reports whether username played White in the game
+func PlayerColor(game *chess.Game, username string) (isWhite bool, ok bool) {
+	var white, black string
 
-	// Lichess formats mates like: "#3", "#-1"
-	if strings.HasPrefix(s, "#") {
-		// check sign
-		if strings.HasPrefix(s, "#-") {
-			return -1000, true
+	for _, t := range game.TagPairs() {
+		switch t.Key {
+		case "White":
+			white = t.Value
+		case "Black":
+			black = t.Value
 		}
-		return 1000, true
 	}
 
-	var v float64
-	_, err := fmt.Sscanf(s, "%f", &v)
-	if err != nil {
-		return 0, false
+	if strings.EqualFold(white, username) {
+		return true, true
 	}
 
-	return v * 100, true // convert to centipawns
+	if strings.EqualFold(black, username) {
+		return false, true
+	}
+
+	return false, false
 }
 
-func computeACPL(game *chess.Game, username string) (float64, bool) {
-	var white, black string
+// PlayerLosses walks the game's evals and returns the loss of each of the player's evaluated moves
+func PlayerLosses(game *chess.Game, username string, opts Options) ([]PlyLoss, bool) {
+	isWhite, ok := PlayerColor(game, username)
+	if !ok {
+		return nil, false
+	}
 
-	for _, t := range game.TagPairs() {
-		switch t.Key {
-		case "White":
-			white = t.Value
-		case "Black":
-			black = t.Value
+	return SideLosses(game, isWhite, opts), true
+}
+
+func (opts Options) keep(game *chess.Game, isWhite bool) bool {
+	for _, f := range opts.Filters {
+		if ef, ok := f.(evalFilter); ok {
+			if !ef.keepEvaluated(game, isWhite, opts) {
+				return false
+			}
+		} else if !f.Keep(game, isWhite) {
+			return false
 		}
 	}
 
-	isWhite := strings.EqualFold(white, username)
-	isBlack := strings.EqualFold(black, username)
-	if !isWhite && !isBlack {
-		return 0, false
+	return true
+}
+
+// analysed reports whether the loss of ply, out of plies, counts towards ACPL.
+// Plies outside this window still update the eval baseline.
+func (opts Options) analysed(ply int, plies int) bool {
+	return ply >= opts.fromPly() && (opts.MaxPlies <= 0 || ply < opts.MaxPlies) && (opts.SkipLastPlies <= 0 || ply < plies-opts.SkipLastPlies)
+}
+
+// fromPly is the index of the first ply FromMove counts, White's move of that number
+func (opts Options) fromPly() int {
+	if opts.FromMove <= 1 {
+		return 0
 	}
+	return 2 * (opts.FromMove - 1)
+}
 
+// tooShort reports whether game ends before MinPlies or before FromMove
+func (opts Options) tooShort(game *chess.Game) bool {
+	plies := len(game.Moves())
+	return plies < opts.MinPlies || (opts.FromMove > 1 && plies <= opts.fromPly())
+}
+
+// SideLosses returns the loss of each evaluated move played by White, or by Black when isWhite is false.
+// A move's loss is the eval of the position before it, which Lichess annotates on the opponent's previous
+// move, minus the eval after it, both from the mover's perspective and clamped to ±1000 like Lichess does.
+// Evals follow the engine's best line, so a move that keeps the eval costs nothing.
+func SideLosses(game *chess.Game, isWhite bool, opts Options) []PlyLoss {
+	return sideLosses(game, opts.plyEvals(game), isWhite, opts)
+}
+
+// sideLosses is SideLosses over the game's evals, as plyEvals returns them
+func sideLosses(game *chess.Game, evals []plyEval, isWhite bool, opts Options) []PlyLoss {
+	isBlack := !isWhite
 	moves := game.Moves()
-	comments := game.Comments()
+	positions := game.Positions()
 
 	var (
-		totalLoss float64
-		count     int
-		prevEval  float64
-		hasPrev   bool
+		losses   []PlyLoss
+		prevEval float64
+		prevPly  int
+		hasPrev  bool
 	)
 
-	for i := 0; i < len(moves) && i < len(comments); i++ {
-		if len(comments[i]) == 0 {
-			continue
-		}
+	if opts.EvaluateFirstMove {
+		prevEval, prevPly, hasPrev = opts.StartingEval, -1, true
+	}
 
-		// use last comment for the move
-		comment := comments[i][len(comments[i])-1]
+	book := opts.bookPlies(game)
+	converting := opts.ConvertingFrom <= 0
 
-		eval, ok := parseEval(comment)
-		if !ok {
+	var times map[int]time.Duration
+	if opts.ExcludePremoves {
+		times = MoveTimes(game)
+	}
+
+	for i, e := range evals {
+		if !e.ok {
 			continue
 		}
 
+		// an eval from before a missing one would charge the player for the unevaluated move too
+		if hasPrev && i-prevPly > 1 {
+			hasPrev = false
+		}
+
+		eval := e.cp
+
 		if eval > 1000 {
 			eval = 1000
 		} else if eval < -1000 {
@@ -111,72 +327,721 @@ func computeACPL(game *chess.Game, username string) (float64, bool) {
 		whiteMove := i%2 == 0
 		playerMove := (whiteMove && isWhite) || (!whiteMove && isBlack)
 
-		if playerMove && hasPrev {
-			loss := prevEval - eval
+		elapsed, timed := times[i]
+		premove := timed && elapsed < PremoveThreshold
+
+		decided := opts.ContestedOnly && math.Abs(prevEval) > opts.DecidedThreshold
+
+		if playerMove && hasPrev && converting && i >= book && !premove && !decided && opts.analysed(i, len(moves)) {
+			before, after := prevEval, eval
 
 			// normalize from player's perspective
 			if isBlack {
-				loss = -loss
+				before, after = -before, -after
 			}
-			if loss < 0 {
+
+			loss := before - after
+			if loss < 0 || loss < opts.NoiseFloor {
 				loss = 0
 			}
 
-			totalLoss += loss
-			count++
+			if opts.MaterialWeighting && i < len(positions) {
+				loss *= MaterialWeight(MaterialBalance(positions[i]))
+			}
+
+			losses = append(losses, PlyLoss{Ply: i, Loss: loss, Before: before, After: after, Recapture: IsRecapture(moves, i)})
 		}
 
 		// update baseline for next ply (always)
 		prevEval = eval
+		prevPly = i
 		hasPrev = true
+
+		if !converting && ((isWhite && eval >= opts.ConvertingFrom) || (isBlack && -eval >= opts.ConvertingFrom)) {
+			converting = true
+		}
 	}
 
-	if count == 0 {
+	// the player's final move is their last or second-to-last ply of the game
+	if opts.IgnoreResignationLoss && len(losses) > 0 && losses[len(losses)-1].Ply >= len(moves)-2 && resignedLost(game, isWhite, prevEval) {
+		losses = losses[:len(losses)-1]
+	}
+
+	return losses
+}
+
+func ComputeACPL(game *chess.Game, username string, opts Options) (float64, bool) {
+	isWhite, ok := PlayerColor(game, username)
+	if !ok {
 		return 0, false
 	}
 
+	return ComputeSideACPL(game, isWhite, opts)
+}
+
+// ComputeOpponentACPL computes the ACPL of whoever played username
+func ComputeOpponentACPL(game *chess.Game, username string, opts Options) (float64, bool) {
+	isWhite, ok := PlayerColor(game, username)
+	if !ok {
+		return 0, false
+	}
+
+	return ComputeSideACPL(game, !isWhite, opts)
+}
+
+func ComputeSideACPL(game *chess.Game, isWhite bool, opts Options) (float64, bool) {
+	return averageLoss(SideLosses(game, isWhite, opts), opts)
+}
+
+func averageLoss(losses []PlyLoss, opts Options) (float64, bool) {
+	totalLoss, count, ok := sumLoss(losses, opts)
+
+	// no critical decisions were mishandled
+	if !ok || count == 0 {
+		return 0, ok
+	}
+
 	return totalLoss / float64(count), true
 }
 
-func RankByACPL(r io.Reader, username string, minPlies int) ([]GameACPL, error) {
+// countedLosses returns the losses that count towards ACPL
+func countedLosses(losses []PlyLoss, opts Options) []PlyLoss {
+	if opts.CriticalOnly {
+		losses = CriticalPlies(losses, opts.CriticalThreshold)
+	}
+
+	if opts.ExcludeUnchanged {
+		losses = ChangedPlies(losses)
+	}
+
+	if opts.ExcludeRecaptures {
+		losses = NonRecaptures(losses)
+	}
+
+	return losses
+}
+
+// sumLoss totals the losses that count towards ACPL and how many there are
+func sumLoss(losses []PlyLoss, opts Options) (totalLoss float64, count int, ok bool) {
+	if len(losses) == 0 || len(losses) < opts.MinEvaluatedPlies {
+		return 0, 0, false
+	}
+
+	losses = countedLosses(losses, opts)
+
+	for _, l := range losses {
+		totalLoss += l.Loss
+	}
+
+	return totalLoss, len(losses), true
+}
+
+// RollingACPL averages each loss with up to window-1 preceding ones. The first values, and all of them
+// when window exceeds the number of losses, average over fewer moves.
+func RollingACPL(losses []PlyLoss, window int) []float64 {
+	if window < 1 {
+		window = 1
+	}
+
+	rolling := make([]float64, 0, len(losses))
+	var sum float64
+
+	for i, l := range losses {
+		sum += l.Loss
+		if i >= window {
+			sum -= losses[i-window].Loss
+		}
+
+		rolling = append(rolling, sum/float64(min(i+1, window)))
+	}
+
+	return rolling
+}
+
+// DefaultWinSteepness is the slope of the logistic model Lichess fits to its games to turn evals into
+// winning chances
+const DefaultWinSteepness = 0.00368208
+
+// WinPercent converts an eval in centipawns into winning chances, with steepness as the model's slope.
+// The steeper it is, the sooner an advantage counts as winning.
+func WinPercent(cp float64, steepness float64) float64 {
+	return 50 + 50*(2/(1+math.Exp(-steepness*cp))-1)
+}
+
+// winSteepness is Options.WinSteepness, or DefaultWinSteepness when unset
+func (opts Options) winSteepness() float64 {
+	if opts.WinSteepness > 0 {
+		return opts.WinSteepness
+	}
+	return DefaultWinSteepness
+}
+
+// ExpectedPointsLost estimates the game points the player's moves threw away, taking winning chances as
+// the expected score: each move costs its drop in WinPercent, divided by 100. Chances given up and won
+// back both count, so the total is capped at the 1 point a game is worth.
+func ExpectedPointsLost(losses []PlyLoss, steepness float64) float64 {
+	var points float64
+	for _, l := range losses {
+		points += max(0, WinPercent(l.Before, steepness)-WinPercent(l.After, steepness)) / 100
+	}
+	return min(1, points)
+}
+
+// MoveAccuracy converts the drop in winning chances caused by a move into Lichess's 0-100 accuracy
+func MoveAccuracy(l PlyLoss, steepness float64) float64 {
+	drop := max(0, WinPercent(l.Before, steepness)-WinPercent(l.After, steepness))
+	accuracy := 103.1668*math.Exp(-0.04354*drop) - 3.1669
+
+	return max(0, min(100, accuracy))
+}
+
+// Accuracy averages MoveAccuracy over the player's moves. Lichess further weights moves by
+// volatility, so its game accuracy will differ slightly.
+func Accuracy(losses []PlyLoss, steepness float64) float64 {
+	if len(losses) == 0 {
+		return 0
+	}
+
+	var total float64
+	for _, l := range losses {
+		total += MoveAccuracy(l, steepness)
+	}
+
+	return total / float64(len(losses))
+}
+
+// WorstLoss returns the ply with the largest loss, the earliest one on ties
+func WorstLoss(losses []PlyLoss) (PlyLoss, bool) {
+	if len(losses) == 0 {
+		return PlyLoss{}, false
+	}
+
+	worst := losses[0]
+	for _, l := range losses[1:] {
+		if l.Loss > worst.Loss {
+			worst = l
+		}
+	}
+
+	return worst, true
+}
+
+// Blunders counts the losses of at least BlunderThreshold
+func Blunders(losses []PlyLoss) int {
+	n := 0
+	for _, l := range losses {
+		if l.Loss >= BlunderThreshold {
+			n++
+		}
+	}
+
+	return n
+}
+
+// MoveLabel names the move at ply in standard notation, e.g. "12... Nf6"
+func MoveLabel(game *chess.Game, ply int) string {
+	moves := game.Moves()
+	positions := game.Positions()
+	if ply < 0 || ply >= len(moves) || ply >= len(positions) {
+		return ""
+	}
+
+	san := chess.AlgebraicNotation{}.Encode(positions[ply], moves[ply])
+
+	if ply%2 == 0 {
+		return fmt.Sprintf("%d. %s", ply/2+1, san)
+	}
+	return fmt.Sprintf("%d... %s", ply/2+1, san)
+}
+
+// CriticalPlies returns the plies whose loss exceeds threshold.
+//
+// Without an engine we cannot know whether a much better alternative existed, so a
+// "critical decision" is approximated as a move that dropped the eval by more than
+// threshold compared to the position after the opponent's reply. Positions where only
+// one good move existed and the player found it are therefore never flagged.
+func CriticalPlies(losses []PlyLoss, threshold float64) []PlyLoss {
+	var critical []PlyLoss
+
+	for _, l := range losses {
+		if l.Loss > threshold {
+			critical = append(critical, l)
+		}
+	}
+
+	return critical
+}
+
+// ChangedPlies returns the plies after which the eval differs from the one before
+func ChangedPlies(losses []PlyLoss) []PlyLoss {
+	var changed []PlyLoss
+
+	for _, l := range losses {
+		if l.Before != l.After {
+			changed = append(changed, l)
+		}
+	}
+
+	return changed
+}
+
+// IsRecapture reports whether the move at ply captured on the square where the opponent just captured
+func IsRecapture(moves []*chess.Move, ply int) bool {
+	if ply < 1 || ply >= len(moves) {
+		return false
+	}
+
+	m, prev := moves[ply], moves[ply-1]
+	return m.HasTag(chess.Capture) && prev.HasTag(chess.Capture) && m.S2() == prev.S2()
+}
+
+// NonRecaptures leaves out the losses of recaptures
+func NonRecaptures(losses []PlyLoss) []PlyLoss {
+	var kept []PlyLoss
+
+	for _, l := range losses {
+		if !l.Recapture {
+			kept = append(kept, l)
+		}
+	}
+
+	return kept
+}
+
+// pieceValues are the usual material values in pawns
+var pieceValues = map[chess.PieceType]int{
+	chess.Pawn:   1,
+	chess.Knight: 3,
+	chess.Bishop: 3,
+	chess.Rook:   5,
+	chess.Queen:  9,
+}
+
+// QueensOn reports whether either side still has a queen, a rough way of telling the middlegame from
+// the endgame
+func QueensOn(pos *chess.Position) bool {
+	for _, piece := range pos.Board().SquareMap() {
+		if piece.Type() == chess.Queen {
+			return true
+		}
+	}
+	return false
+}
+
+// MaterialBalance returns White's material minus Black's, in pawns
+func MaterialBalance(pos *chess.Position) int {
+	balance := 0
+
+	for _, piece := range pos.Board().SquareMap() {
+		if piece.Color() == chess.White {
+			balance += pieceValues[piece.Type()]
+		} else {
+			balance -= pieceValues[piece.Type()]
+		}
+	}
+
+	return balance
+}
+
+// MaterialWeight is how much a loss counts given the material balance before the move:
+// 1 / (1 + |balance| / 3). Precision matters less once a side is well ahead, so a loss with
+// a minor piece of imbalance counts half and one with a rook of imbalance about a third.
+func MaterialWeight(balance int) float64 {
+	return 1 / (1 + math.Abs(float64(balance))/3)
+}
+
+// LowestEval returns the worst eval the player faced over the whole game, in centipawns from
+// their perspective, and the ply after which it occurred, the earliest one on ties
+func LowestEval(game *chess.Game, isWhite bool, opts Options) (lowest float64, ply int, ok bool) {
+	return lowestEval(opts.plyEvals(game), isWhite)
+}
+
+// lowestEval is LowestEval over the game's evals
+func lowestEval(evals []plyEval, isWhite bool) (lowest float64, ply int, ok bool) {
+	for i, e := range evals {
+		if !e.ok {
+			continue
+		}
+
+		eval := max(-1000, min(1000, e.cp))
+		if !isWhite {
+			eval = -eval
+		}
+
+		if !ok || eval < lowest {
+			lowest, ply, ok = eval, i, true
+		}
+	}
+
+	return lowest, ply, ok
+}
+
+// Won reports whether White won the game, or Black when isWhite is false
+func Won(game *chess.Game, isWhite bool) bool {
+	result := TagValue(game, "Result")
+	return (isWhite && result == "1-0") || (!isWhite && result == "0-1")
+}
+
+// Drawn reports whether the game ended in a draw
+func Drawn(game *chess.Game) bool {
+	return TagValue(game, "Result") == "1/2-1/2"
+}
+
+// AccurateDraws returns the drawn games in which both players averaged at most maxACPL, most accurate
+// first by their combined ACPL. Games without the opponent's ACPL are left out, as they cannot be told
+// apart from one-sided draws.
+func AccurateDraws(results []GameACPL, maxACPL float64) []GameACPL {
+	var draws []GameACPL
+
+	for _, r := range results {
+		if Drawn(r.Game) && r.HasOpponentACPL && r.ACPL <= maxACPL && r.OpponentACPL <= maxACPL {
+			draws = append(draws, r)
+		}
+	}
+
+	sort.SliceStable(draws, func(i, j int) bool {
+		return draws[i].ACPL+draws[i].OpponentACPL < draws[j].ACPL+draws[j].OpponentACPL
+	})
+
+	return draws
+}
+
+// resignedLost reports whether the player lost without being mated while the final eval was clearly against them.
+// Lichess marks resignations as a "Normal" termination, so checkmates are told apart using the final position.
+func resignedLost(game *chess.Game, isWhite bool, finalEval float64) bool {
+	termination := TagValue(game, "Termination")
+	if termination != "Normal" && !strings.Contains(strings.ToLower(termination), "resign") {
+		return false
+	}
+
+	result := TagValue(game, "Result")
+	if (isWhite && result != "0-1") || (!isWhite && result != "1-0") {
+		return false
+	}
+
+	if game.Position().Status() == chess.Checkmate {
+		return false
+	}
+
+	if !isWhite {
+		finalEval = -finalEval
+	}
+
+	return finalEval <= -lostThreshold
+}
+
+// FlaggedWhileWinning reports whether the player lost on time, as Lichess's "Time forfeit" termination
+// says, while the final eval was at least lostThreshold in their favour
+func FlaggedWhileWinning(game *chess.Game, isWhite bool, opts Options) bool {
+	if TagValue(game, "Termination") != "Time forfeit" || !Won(game, !isWhite) {
+		return false
+	}
+
+	eval, ok := FinalEval(game, isWhite, opts)
+	return ok && eval >= lostThreshold
+}
+
+// FinalEval returns the last eval of the game, in centipawns from the player's perspective
+func FinalEval(game *chess.Game, isWhite bool, opts Options) (float64, bool) {
+	evals := opts.plyEvals(game)
+
+	for i := len(evals) - 1; i >= 0; i-- {
+		if evals[i].ok {
+			if isWhite {
+				return evals[i].cp, true
+			}
+			return -evals[i].cp, true
+		}
+	}
+
+	return 0, false
+}
+
+// ParseGame reads a single game from PGN
+func ParseGame(r io.Reader) (*chess.Game, error) {
+	opt, err := chess.PGN(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return chess.NewGame(opt), nil
+}
+
+// snippet returns the start of pgn, cut to rejectedSnippetLength characters
+func snippet(pgn string) string {
+	pgn = strings.ToValidUTF8(strings.TrimSpace(pgn), "\uFFFD")
+	if runes := []rune(pgn); len(runes) > rejectedSnippetLength {
+		return string(runes[:rejectedSnippetLength]) + "…"
+	}
+	return pgn
+}
+
+// StdDev is the population standard deviation of the losses
+func StdDev(losses []PlyLoss) float64 {
+	if len(losses) == 0 {
+		return 0
+	}
+
+	var mean float64
+	for _, l := range losses {
+		mean += l.Loss
+	}
+	mean /= float64(len(losses))
+
+	var variance float64
+	for _, l := range losses {
+		variance += (l.Loss - mean) * (l.Loss - mean)
+	}
+
+	return math.Sqrt(variance / float64(len(losses)))
+}
+
+func score(acpl float64, opponentACPL float64, stdDev float64, game *chess.Game, evals []plyEval, opts Options) float64 {
+	switch opts.SortBy {
+	case SortGap:
+		return acpl - opponentACPL
+	case SortLengthAdjusted:
+		return LengthAdjustedACPL(acpl, len(game.Moves()))
+	case SortConsistency:
+		return acpl + opts.ConsistencyWeight*stdDev
+	case SortSharpness:
+		return SharpnessAdjustedACPL(acpl, evalVolatility(evals))
+	default:
+		return acpl
+	}
+}
+
+// EvalVolatility is the standard deviation of the game's evals, capped at ±10 pawns like losses are,
+// in centipawns. It is 0 for games with fewer than two evals.
+func EvalVolatility(game *chess.Game, opts Options) float64 {
+	return evalVolatility(opts.plyEvals(game))
+}
+
+// evalVolatility is EvalVolatility over the game's evals
+func evalVolatility(plies []plyEval) float64 {
+	var evals []float64
+	for _, e := range plies {
+		if e.ok {
+			evals = append(evals, max(-1000, min(1000, e.cp)))
+		}
+	}
+
+	if len(evals) < 2 {
+		return 0
+	}
+
+	var mean float64
+	for _, e := range evals {
+		mean += e
+	}
+	mean /= float64(len(evals))
+
+	var variance float64
+	for _, e := range evals {
+		variance += (e - mean) * (e - mean)
+	}
+
+	return math.Sqrt(variance / float64(len(evals)))
+}
+
+// SharpnessAdjustedACPL scales ACPL by sharpnessScale / (sharpnessScale + volatility), so an eval
+// volatility of 100 centipawns halves it and one of 300 quarters it, while quiet games keep their ACPL
+func SharpnessAdjustedACPL(acpl float64, volatility float64) float64 {
+	return acpl * sharpnessScale / (sharpnessScale + volatility)
+}
+
+// LengthAdjustedACPL divides ACPL by log2 of the game's length in plies
+func LengthAdjustedACPL(acpl float64, plies int) float64 {
+	if plies < 2 {
+		return acpl
+	}
+
+	return acpl / math.Log2(float64(plies))
+}
+
+func RankByACPL(r io.Reader, username string, opts Options) ([]GameACPL, error) {
+	return RankByACPLContext(context.Background(), r, username, opts)
+}
+
+// RankByACPLContext is RankByACPL, stopping with ctx's error once ctx is done
+func RankByACPLContext(ctx context.Context, r io.Reader, username string, opts Options) ([]GameACPL, error) {
+	results, _, err := RankWithExclusions(ctx, r, username, opts)
+	return results, err
+}
+
+// rejectedSnippetLength is how much of an unreadable game RejectedGame quotes
+const rejectedSnippetLength = 200
+
+// RejectedGame is a game that could not be parsed, with the start of its PGN
+type RejectedGame struct {
+	Snippet string `json:"snippet"`
+	Error   string `json:"error"`
+}
+
+// Exclusions are the games left out of a ranking for a reason worth reporting
+type Exclusions struct {
+	// Suspect counts the games Options.ExcludeSuspect left out, by reason
+	Suspect map[string]int
+	// Rejected are the games that could not be parsed, only collected with Options.StrictPGN
+	Rejected []RejectedGame
+}
+
+// Add counts the games other left out too
+func (e *Exclusions) Add(other Exclusions) {
+	if e.Suspect == nil {
+		e.Suspect = make(map[string]int)
+	}
+	for reason, n := range other.Suspect {
+		e.Suspect[reason] += n
+	}
+
+	e.Rejected = append(e.Rejected, other.Rejected...)
+}
+
+// RankWithExclusions is RankByACPLContext, also reporting the games it left out, see Exclusions
+func RankWithExclusions(ctx context.Context, r io.Reader, username string, opts Options) ([]GameACPL, Exclusions, error) {
 	scanner := bufio.NewScanner(r)
 	scanner.Split(splitPGN)
 
 	var out []GameACPL
+	seen := make(map[string]bool)
+	excluded := Exclusions{Suspect: make(map[string]int)}
 
 	for scanner.Scan() {
+		if err := ctx.Err(); err != nil {
+			return nil, Exclusions{}, err
+		}
+
 		pgn := scanner.Text()
 		if strings.TrimSpace(pgn) == "" {
 			continue
 		}
 
-		opt, err := chess.PGN(strings.NewReader(pgn))
+		game, err := ParseGame(strings.NewReader(pgn))
 		if err != nil {
+			if opts.StrictPGN {
+				excluded.Rejected = append(excluded.Rejected, RejectedGame{Snippet: snippet(pgn), Error: err.Error()})
+			}
 			continue // malformed PGN
 		}
 
-		game := chess.NewGame(opt)
+		if opts.tooShort(game) {
+			continue
+		}
 
-		if len(game.Moves()) < minPlies {
+		key := GameKey(game)
+		if seen[key] {
+			continue // duplicate game
+		}
+		seen[key] = true
+
+		isWhite, ok := PlayerColor(game, username)
+		if !ok || !opts.keep(game, isWhite) {
 			continue
 		}
 
-		acpl, ok := computeACPL(game, username)
+		// the evals are read, or asked of opts.Provider, once for everything below
+		evals := opts.plyEvals(game)
+
+		suspect := suspectReason(evals)
+		if suspect != "" && opts.ExcludeSuspect {
+			excluded.Suspect[suspect]++
+			continue
+		}
+
+		losses := sideLosses(game, evals, isWhite, opts)
+
+		totalLoss, count, ok := sumLoss(losses, opts)
 		if !ok {
 			continue
 		}
 
+		acpl, _ := averageLoss(losses, opts)
+		counted := countedLosses(losses, opts)
+		stdDev := StdDev(counted)
+
+		opponentACPL, hasOpponentACPL := averageLoss(sideLosses(game, evals, !isWhite, opts), opts)
+		if opts.SortBy == SortGap && !hasOpponentACPL {
+			continue
+		}
+
+		worst, hasWorst := WorstLoss(losses)
+		lowest, lowestPly, hasLowest := lowestEval(evals, isWhite)
+		turningPoint, hasTurningPoint := findTurningPoint(evals, losses)
+
+		theoryPlies, hasTheoryPlies := 0, false
+		if opts.TheoryDepth {
+			theoryPlies, hasTheoryPlies = TheoryPlies(game)
+		}
+
 		out = append(out, GameACPL{
-			Game: game,
-			ACPL: acpl,
+			Game:               game,
+			IsWhite:            isWhite,
+			ACPL:               acpl,
+			OpponentACPL:       opponentACPL,
+			HasOpponentACPL:    hasOpponentACPL,
+			Losses:             losses,
+			Counted:            counted,
+			TotalLoss:          totalLoss,
+			Count:              count,
+			StdDev:             stdDev,
+			Accuracy:           Accuracy(losses, opts.winSteepness()),
+			ExpectedPointsLost: ExpectedPointsLost(losses, opts.winSteepness()),
+			Worst:              worst,
+			HasWorst:           hasWorst,
+			Lowest:             lowest,
+			LowestPly:          lowestPly,
+			HasLowest:          hasLowest,
+			Score:              score(acpl, opponentACPL, stdDev, game, evals, opts),
+			Blunders:           Blunders(counted),
+			Suspect:            suspect,
+			TurningPoint:       turningPoint,
+			HasTurningPoint:    hasTurningPoint,
+			TheoryPlies:        theoryPlies,
+			HasTheoryPlies:     hasTheoryPlies,
+			Eligible:           count >= opts.MinRankedPlies,
 		})
 	}
 
-	sort.Slice(out, func(i, j int) bool {
-		return out[i].ACPL < out[j].ACPL
+	sortRanking(out, opts)
+
+	return out, excluded, scanner.Err()
+}
+
+// sortRanking puts the eligible games first, then the most accurate as opts says, keeping the order of
+// the PGN between equals
+func sortRanking(results []GameACPL, opts Options) {
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Eligible != results[j].Eligible {
+			return results[i].Eligible
+		}
+		if opts.SortBy == SortBlunders && results[i].Blunders != results[j].Blunders {
+			return results[i].Blunders < results[j].Blunders
+		}
+		return results[i].Score < results[j].Score
 	})
+}
+
+// MergeRankings ranks the games of two rankings made with the same opts together, as RankWithExclusions
+// would rank their PGN one after the other, so that older games can be added without ranking the earlier
+// ones again
+func MergeRankings(earlier []GameACPL, later []GameACPL, opts Options) []GameACPL {
+	merged := make([]GameACPL, 0, len(earlier)+len(later))
+	seen := make(map[string]bool, len(earlier))
+
+	for _, r := range earlier {
+		seen[GameKey(r.Game)] = true
+		merged = append(merged, r)
+	}
+
+	for _, r := range later {
+		if !seen[GameKey(r.Game)] {
+			merged = append(merged, r)
+		}
+	}
 
-	return out, scanner.Err()
+	sortRanking(merged, opts)
+	return merged
 }
 
 func TagValue(g *chess.Game, key string) string {
@@ -187,3 +1052,110 @@ func TagValue(g *chess.Game, key string) string {
 	}
 	return ""
 }
+
+// GameKey identifies a game by its GameId tag, or by a hash of its tags and opening moves
+// for exports that lack one, such as studies and broadcasts
+func GameKey(g *chess.Game) string {
+	if id := TagValue(g, "GameId"); id != "" {
+		return id
+	}
+
+	tags := make([]string, 0, len(g.TagPairs()))
+	for _, t := range g.TagPairs() {
+		tags = append(tags, t.Key+"="+t.Value)
+	}
+	sort.Strings(tags)
+
+	h := sha1.New()
+	for _, t := range tags {
+		io.WriteString(h, t+"\n")
+	}
+
+	for i, m := range g.Moves() {
+		if i >= 20 {
+			break
+		}
+		io.WriteString(h, m.String()+" ")
+	}
+
+	return hex.EncodeToString(h.Sum(nil))[:12]
+}
+
+// ParseTimeControl splits a TimeControl tag such as "180+2", or "600" without increment, into base and increment seconds.
+// Correspondence and unlimited games use "-" and are reported as not ok.
+func ParseTimeControl(tag string) (base int, increment int, ok bool) {
+	b, i, found := strings.Cut(strings.TrimSpace(tag), "+")
+	if !found {
+		// a bare base time, e.g. "600"
+		i = "0"
+	}
+
+	base, err := strconv.Atoi(b)
+	if err != nil || base < 0 {
+		return 0, 0, false
+	}
+
+	increment, err = strconv.Atoi(i)
+	if err != nil || increment < 0 {
+		return 0, 0, false
+	}
+
+	return base, increment, true
+}
+
+// TimeControlCategory names a game's speed the way Lichess does, from the estimated
+// duration base + 40 * increment, e.g. "blitz" for "180+2"
+func TimeControlCategory(g *chess.Game) string {
+	base, increment, ok := ParseTimeControl(TagValue(g, "TimeControl"))
+	if !ok {
+		return "correspondence"
+	}
+
+	switch estimated := base + 40*increment; {
+	case estimated < 30:
+		return "ultraBullet"
+	case estimated < 180:
+		return "bullet"
+	case estimated < 480:
+		return "blitz"
+	case estimated < 1500:
+		return "rapid"
+	default:
+		return "classical"
+	}
+}
+
+// GameTime reads when a game started from its UTCDate and UTCTime tags
+func GameTime(g *chess.Game) (time.Time, bool) {
+	t, err := time.Parse("2006.01.02 15:04:05", TagValue(g, "UTCDate")+" "+TagValue(g, "UTCTime"))
+	if err != nil {
+		return time.Time{}, false
+	}
+
+	return t, true
+}
+
+var utcTagsPattern = regexp.MustCompile(`\[UTCDate "(\d{4}\.\d{2}\.\d{2})"\]\s*\[UTCTime "(\d{2}:\d{2}:\d{2})"\]`)
+
+// OldestGameTime scans a PGN export for the earliest UTCDate and UTCTime tags without parsing the games
+func OldestGameTime(pgn []byte) (time.Time, bool) {
+	var oldest time.Time
+
+	for _, m := range utcTagsPattern.FindAllSubmatch(pgn, -1) {
+		t, err := time.Parse("2006.01.02 15:04:05", string(m[1])+" "+string(m[2]))
+		if err != nil {
+			continue
+		}
+
+		if oldest.IsZero() || t.Before(oldest) {
+			oldest = t
+		}
+	}
+
+	return oldest, !oldest.IsZero()
+}
+
+// CountGames counts the games in a PGN export without parsing them
+func CountGames(pgn []byte) int {
+	return bytes.Count(pgn, []byte("[Event "))
+}
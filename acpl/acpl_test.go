@@ -0,0 +1,285 @@
+package acpl
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// testMoves are four moves each with evals to the centipawn, so that losses come out exact. White loses 0,
+// 70 and 5 on plies 2, 4 and 6; Black 0, 0, 60 and 395 on plies 1, 3, 5 and 7.
+const testMoves = `1. e4 { [%eval 0.3] } 1... e5 { [%eval 0.2] } 2. Nf3 { [%eval 0.25] } 2... Nc6 { [%eval 0.2] } ` +
+	`3. Bc4 { [%eval -0.5] } 3... Nf6 { [%eval 0.1] } 4. Ng5 { [%eval 0.05] } 4... d5 { [%eval 4.0] }`
+
+// constantMoves are five moves all evaluated 0, which Suspect reports
+const constantMoves = `1. e4 { [%cp 0] } 1... e5 { [%cp 0] } 2. Nf3 { [%cp 0] } 2... Nc6 { [%cp 0] } ` +
+	`3. Bc4 { [%cp 0] } 3... Bc5 { [%cp 0] } 4. c3 { [%cp 0] } 4... Nf6 { [%cp 0] } ` +
+	`5. d4 { [%cp 0] } 5... exd4 { [%cp 0] }`
+
+// testPGN is a game export as Lichess writes them, Black having resigned
+func testPGN(id string, white string, black string, moves string) string {
+	return fmt.Sprintf(`[Event "Rated blitz game"]
+[White %q]
+[Black %q]
+[Result "1-0"]
+[GameId %q]
+[TimeControl "180+2"]
+[Termination "Normal"]
+
+%s 1-0
+`, white, black, id, moves)
+}
+
+// ruyLopez are the 30 plies of a closed Ruy Lopez
+var ruyLopez = strings.Fields("e4 e5 Nf3 Nc6 Bb5 a6 Ba4 Nf6 O-O Be7 Re1 b5 Bb3 d6 c3 O-O h3 Nb8 d4 Nbd7 " +
+	"c4 c6 cxb5 axb5 Nc3 Bb7 Bg5 b4 Nb1 h6")
+
+// longGame is alice's game of ruyLopez as White, with evals on only its first evaluated plies
+func longGame(id string, evaluated int) string {
+	var moves strings.Builder
+
+	for i, m := range ruyLopez {
+		if i%2 == 0 {
+			fmt.Fprintf(&moves, "%d. ", i/2+1)
+		}
+		moves.WriteString(m + " ")
+		if i < evaluated {
+			moves.WriteString("{ [%eval 0.2] } ")
+		}
+	}
+
+	return fmt.Sprintf("[Event \"Rated blitz game\"]\n[White \"alice\"]\n[Black \"bob\"]\n[Result \"*\"]\n[GameId %q]\n\n%s*\n", id, moves.String())
+}
+
+func TestMinEvaluatedPlies(t *testing.T) {
+	// both games are 30 plies long, but alice has only 2 evaluated moves in the sparse one
+	pgn := longGame("sparse", 5) + "\n\n\n" + longGame("dense", len(ruyLopez))
+
+	tests := []struct {
+		name string
+		opts Options
+		want []string
+	}{
+		{"no minimum", Options{}, []string{"dense", "sparse"}},
+		{"long enough", Options{MinPlies: 30}, []string{"dense", "sparse"}},
+		{"too few evaluated plies", Options{MinPlies: 30, MinEvaluatedPlies: 10}, []string{"dense"}},
+		{"too many evaluated plies required", Options{MinEvaluatedPlies: 15}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results, err := RankByACPL(strings.NewReader(pgn), "alice", tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, r := range results {
+				got = append(got, TagValue(r.Game, "GameId"))
+			}
+			slices.Sort(got)
+
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("ranked %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSideLosses(t *testing.T) {
+	game, err := ParseGame(strings.NewReader(testPGN("test", "alice", "bob", testMoves)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		opts    Options
+		isWhite bool
+		want    []PlyLoss
+	}{
+		{
+			name:    "white",
+			isWhite: true,
+			want:    []PlyLoss{{Ply: 2, Loss: 0}, {Ply: 4, Loss: 70}, {Ply: 6, Loss: 5}},
+		},
+		{
+			name: "black",
+			want: []PlyLoss{{Ply: 1, Loss: 0}, {Ply: 3, Loss: 0}, {Ply: 5, Loss: 60}, {Ply: 7, Loss: 395}},
+		},
+		{
+			name:    "first move evaluated",
+			opts:    Options{EvaluateFirstMove: true, StartingEval: 50},
+			isWhite: true,
+			want:    []PlyLoss{{Ply: 0, Loss: 20}, {Ply: 2, Loss: 0}, {Ply: 4, Loss: 70}, {Ply: 6, Loss: 5}},
+		},
+		{
+			name:    "noise floor",
+			opts:    Options{NoiseFloor: 10},
+			isWhite: true,
+			want:    []PlyLoss{{Ply: 2, Loss: 0}, {Ply: 4, Loss: 70}, {Ply: 6, Loss: 0}},
+		},
+		{
+			name:    "from move",
+			opts:    Options{FromMove: 3},
+			isWhite: true,
+			want:    []PlyLoss{{Ply: 4, Loss: 70}, {Ply: 6, Loss: 5}},
+		},
+		{
+			name:    "max plies",
+			opts:    Options{MaxPlies: 5},
+			isWhite: true,
+			want:    []PlyLoss{{Ply: 2, Loss: 0}, {Ply: 4, Loss: 70}},
+		},
+		{
+			name: "last plies skipped",
+			opts: Options{SkipLastPlies: 2},
+			want: []PlyLoss{{Ply: 1, Loss: 0}, {Ply: 3, Loss: 0}, {Ply: 5, Loss: 60}},
+		},
+		{
+			name: "contested only",
+			opts: Options{ContestedOnly: true, DecidedThreshold: 40},
+			want: []PlyLoss{{Ply: 1, Loss: 0}, {Ply: 3, Loss: 0}, {Ply: 7, Loss: 395}},
+		},
+		{
+			name: "converting",
+			opts: Options{ConvertingFrom: 40},
+			want: []PlyLoss{{Ply: 5, Loss: 60}, {Ply: 7, Loss: 395}},
+		},
+		{
+			name: "resignation loss ignored",
+			opts: Options{IgnoreResignationLoss: true},
+			want: []PlyLoss{{Ply: 1, Loss: 0}, {Ply: 3, Loss: 0}, {Ply: 5, Loss: 60}},
+		},
+		{
+			name:    "resignation loss of the winner kept",
+			opts:    Options{IgnoreResignationLoss: true},
+			isWhite: true,
+			want:    []PlyLoss{{Ply: 2, Loss: 0}, {Ply: 4, Loss: 70}, {Ply: 6, Loss: 5}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []PlyLoss
+			for _, l := range SideLosses(game, tt.isWhite, tt.opts) {
+				got = append(got, PlyLoss{Ply: l.Ply, Loss: l.Loss})
+			}
+
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("SideLosses() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRankWithExclusions(t *testing.T) {
+	pgn := strings.Join([]string{
+		// alice's ACPL is 25 as White
+		testPGN("white", "alice", "bob", testMoves),
+		// and 113.75 as Black
+		testPGN("black", "bob", "alice", testMoves),
+		testPGN("white", "alice", "bob", testMoves),
+		testPGN("constant", "alice", "bob", constantMoves),
+		testPGN("others", "carol", "bob", testMoves),
+		"[Event \"Rated blitz game\"]\n\n1. e4 e5 2. Ke3 Ke6 *\n",
+	}, "\n\n")
+
+	tests := []struct {
+		name     string
+		opts     Options
+		want     []string
+		suspect  map[string]int
+		rejected int
+	}{
+		{
+			name:    "by acpl",
+			want:    []string{"constant", "white", "black"},
+			suspect: map[string]int{},
+		},
+		{
+			name:    "by gap",
+			opts:    Options{SortBy: SortGap},
+			want:    []string{"white", "constant", "black"},
+			suspect: map[string]int{},
+		},
+		{
+			name:    "eligible first",
+			opts:    Options{MinRankedPlies: 4},
+			want:    []string{"constant", "black", "white"},
+			suspect: map[string]int{},
+		},
+		{
+			name:    "too short",
+			opts:    Options{MinPlies: 9},
+			want:    []string{"constant"},
+			suspect: map[string]int{},
+		},
+		{
+			name:    "suspect excluded",
+			opts:    Options{ExcludeSuspect: true},
+			want:    []string{"white", "black"},
+			suspect: map[string]int{SuspectConstant: 1},
+		},
+		{
+			name:     "strict",
+			opts:     Options{StrictPGN: true},
+			want:     []string{"constant", "white", "black"},
+			suspect:  map[string]int{},
+			rejected: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results, excluded, err := RankWithExclusions(context.Background(), strings.NewReader(pgn), "alice", tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, r := range results {
+				got = append(got, GameKey(r.Game))
+			}
+
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("ranked %v, want %v", got, tt.want)
+			}
+			if !maps.Equal(excluded.Suspect, tt.suspect) {
+				t.Errorf("excluded.Suspect = %v, want %v", excluded.Suspect, tt.suspect)
+			}
+			if len(excluded.Rejected) != tt.rejected {
+				t.Errorf("excluded.Rejected = %v, want %d", excluded.Rejected, tt.rejected)
+			}
+		})
+	}
+}
+
+func TestEligibleCountsScoredMoves(t *testing.T) {
+	// the eval only moves on alice's third move, so that ExcludeUnchanged scores one of her five moves
+	const quietMoves = `1. e4 { [%cp 30] } 1... e5 { [%cp 30] } 2. Nf3 { [%cp 30] } 2... Nc6 { [%cp 30] } ` +
+		`3. Bc4 { [%cp 40] } 3... Bc5 { [%cp 40] } 4. c3 { [%cp 40] } 4... Nf6 { [%cp 40] } ` +
+		`5. d4 { [%cp 40] } 5... exd4 { [%cp 40] } 6. cxd4 { [%cp 40] } 6... Bb4+ { [%cp 40] }`
+
+	pgn := testPGN("quiet", "alice", "bob", quietMoves) + "\n\n" + testPGN("busy", "alice", "bob", testMoves)
+	opts := Options{ExcludeUnchanged: true, MinRankedPlies: 3}
+
+	results, err := RankByACPL(strings.NewReader(pgn), "alice", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, r := range results {
+		got = append(got, fmt.Sprintf("%s %d %v", GameKey(r.Game), r.Count, r.Eligible))
+	}
+
+	// the quiet game's one flawless scored move does not put it ahead of a game scored on three
+	want := []string{"busy 3 true", "quiet 1 false"}
+	if !slices.Equal(got, want) {
+		t.Errorf("ranked %q, want %q", got, want)
+	}
+}
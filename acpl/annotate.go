@@ -0,0 +1,101 @@
+package acpl
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/notnil/chess"
+)
+
+// NAG returns the numeric annotation glyph for a move losing loss centipawns:
+// "$4" (??) for blunders, "$2" (?) for mistakes, "$6" (?!) for inaccuracies, or "" otherwise
+func NAG(loss float64) string {
+	switch {
+	case loss >= BlunderThreshold:
+		return "$4"
+	case loss >= MistakeThreshold:
+		return "$2"
+	case loss >= InaccuracyThreshold:
+		return "$6"
+	default:
+		return ""
+	}
+}
+
+// Classify names a move losing loss centipawns "blunder", "mistake" or "inaccuracy", or returns "" for a good move
+func Classify(loss float64) string {
+	switch {
+	case loss >= BlunderThreshold:
+		return "blunder"
+	case loss >= MistakeThreshold:
+		return "mistake"
+	case loss >= InaccuracyThreshold:
+		return "inaccuracy"
+	default:
+		return ""
+	}
+}
+
+// The PGN standard escapes quotes and backslashes in tag values. The parser keeps a value's escapes, so they
+// are undone before escaping it again, not to escape them twice.
+var (
+	tagUnescaper = strings.NewReplacer(`\\`, `\`, `\"`, `"`)
+	tagEscaper   = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+)
+
+// AnnotatedPGN writes the game as PGN with the moves of both sides marked by NAG, keeping the
+// original tags and comments, so that it can be imported into a Lichess study. A comment cannot hold a
+// closing brace, which would end it early, so those are dropped.
+func AnnotatedPGN(game *chess.Game, opts Options) string {
+	nags := make(map[int]string)
+	for _, isWhite := range []bool{true, false} {
+		for _, l := range SideLosses(game, isWhite, opts) {
+			if nag := NAG(l.Loss); nag != "" {
+				nags[l.Ply] = nag
+			}
+		}
+	}
+
+	var b strings.Builder
+
+	for _, tag := range game.TagPairs() {
+		b.WriteString("[" + tag.Key + " \"" + tagEscaper.Replace(tagUnescaper.Replace(tag.Value)) + "\"]\n")
+	}
+	b.WriteString("\n")
+
+	moves := game.Moves()
+	positions := game.Positions()
+	comments := game.Comments()
+
+	// Black's move needs its number again after anything interrupts the movetext
+	interrupted := false
+
+	for i, move := range moves {
+		if i%2 == 0 {
+			b.WriteString(strconv.Itoa(i/2+1) + ". ")
+		} else if interrupted {
+			b.WriteString(strconv.Itoa(i/2+1) + "... ")
+		}
+
+		b.WriteString(chess.AlgebraicNotation{}.Encode(positions[i], move))
+		interrupted = false
+
+		if nag := nags[i]; nag != "" {
+			b.WriteString(" " + nag)
+			interrupted = true
+		}
+
+		if i < len(comments) {
+			for _, c := range comments[i] {
+				b.WriteString(" { " + strings.ReplaceAll(c, "}", "") + " }")
+				interrupted = true
+			}
+		}
+
+		b.WriteString(" ")
+	}
+
+	b.WriteString(string(game.Outcome()) + "\n")
+
+	return b.String()
+}
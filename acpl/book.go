@@ -0,0 +1,65 @@
+package acpl
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/notnil/chess"
+	"github.com/notnil/chess/opening"
+)
+
+// ecoBook is the opening book Lichess names openings after, loaded on first use as parsing it takes a while
+var ecoBook = sync.OnceValue(opening.NewBookECO)
+
+// BookPlies returns how many plies the game spent in the opening book. Lichess tags each game with the
+// deepest named opening it reached, so the depth is only known when the book agrees with the Opening tag;
+// it does not for transpositions or renamed openings.
+func BookPlies(game *chess.Game) (int, bool) {
+	tag := TagValue(game, "Opening")
+	if tag == "" || tag == "?" {
+		return 0, false
+	}
+
+	o := ecoBook().Find(game.Moves())
+	if o == nil || o.Title() != tag {
+		return 0, false
+	}
+
+	return linePlies(o), true
+}
+
+// TheoryPlies returns how many plies the game followed the deepest named line of the opening book it
+// reached, i.e. the ply of its novelty. Unlike BookPlies it does not rely on the Opening tag, so it also
+// works for games without one, but a transposition counts only as far as the line the moves follow.
+func TheoryPlies(game *chess.Game) (int, bool) {
+	o := ecoBook().Find(game.Moves())
+	if o == nil {
+		return 0, false
+	}
+
+	return linePlies(o), true
+}
+
+// linePlies counts the plies of an opening's line
+func linePlies(o *opening.Opening) int {
+	plies := 0
+	for token := range strings.FieldsSeq(o.PGN()) {
+		if !strings.HasSuffix(token, ".") {
+			plies++
+		}
+	}
+
+	return plies
+}
+
+// bookPlies is the number of plies whose losses SkipBook leaves out
+func (opts Options) bookPlies(game *chess.Game) int {
+	if !opts.SkipBook {
+		return 0
+	}
+
+	if plies, ok := BookPlies(game); ok {
+		return plies
+	}
+	return opts.FallbackBookPlies
+}
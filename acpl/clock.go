@@ -0,0 +1,120 @@
+package acpl
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/notnil/chess"
+)
+
+// parseClock reads an h:mm:ss time such as "0:03:00" or "0:00:01.5"
+func parseClock(s string) (time.Duration, bool) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return 0, false
+	}
+
+	hours, err1 := strconv.Atoi(parts[0])
+	minutes, err2 := strconv.Atoi(parts[1])
+	seconds, ok := parseNumber(parts[2])
+	if err1 != nil || err2 != nil || !ok || hours < 0 || minutes < 0 || seconds < 0 {
+		return 0, false
+	}
+
+	return time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute + time.Duration(seconds*float64(time.Second)), true
+}
+
+// PremoveThreshold is how quickly a move must be made to be taken for a premove. Lichess clocks are
+// exported in whole seconds, so an instant move can show up to a second less than it took.
+const PremoveThreshold = 500 * time.Millisecond
+
+// MoveTimes returns how long each ply took, keyed by ply, for the plies where it is known. An [%emt]
+// annotation gives it directly and is preferred; otherwise it is the drop in the mover's [%clk] since
+// their previous move plus the increment, which leaves out each side's first move.
+func MoveTimes(game *chess.Game) map[int]time.Duration {
+	_, increment, _ := ParseTimeControl(TagValue(game, "TimeControl"))
+
+	times := make(map[int]time.Duration)
+	clocks := make(map[int]time.Duration)
+
+	for i, comments := range game.Comments() {
+		if i >= len(game.Moves()) {
+			break
+		}
+
+		for _, c := range comments {
+			if s, ok := annotationValue(c, "%emt "); ok {
+				if d, ok := parseClock(s); ok {
+					times[i] = d
+				}
+			}
+
+			if s, ok := annotationValue(c, "%clk "); ok {
+				if d, ok := parseClock(s); ok {
+					clocks[i] = d
+				}
+			}
+		}
+
+		if _, ok := times[i]; ok {
+			continue
+		}
+
+		clock, ok := clocks[i]
+		previous, hasPrevious := clocks[i-2]
+		if ok && hasPrevious {
+			times[i] = max(0, previous-clock+time.Duration(increment)*time.Second)
+		}
+	}
+
+	return times
+}
+
+// GameDuration returns how long both players spent on the clock. With [%clk] annotations from both
+// sides it is each side's base time plus increments minus their last clock; otherwise it is the sum
+// of any [%emt] annotations. It is not ok for games carrying neither.
+func GameDuration(game *chess.Game) (time.Duration, bool) {
+	base, increment, hasTimeControl := ParseTimeControl(TagValue(game, "TimeControl"))
+
+	var last [2]time.Duration
+	var hasClock [2]bool
+	var moves [2]int
+	var elapsed time.Duration
+	hasElapsed := false
+
+	for i, comments := range game.Comments() {
+		if i >= len(game.Moves()) {
+			break
+		}
+
+		side := i % 2
+		moves[side]++
+
+		for _, c := range comments {
+			if s, ok := annotationValue(c, "%clk "); ok {
+				if d, ok := parseClock(s); ok {
+					last[side], hasClock[side] = d, true
+				}
+			}
+
+			if s, ok := annotationValue(c, "%emt "); ok {
+				if d, ok := parseClock(s); ok {
+					elapsed += d
+					hasElapsed = true
+				}
+			}
+		}
+	}
+
+	if hasTimeControl && hasClock[0] && hasClock[1] {
+		var total time.Duration
+		for side := range 2 {
+			start := time.Duration(base+moves[side]*increment) * time.Second
+			total += max(0, start-last[side])
+		}
+		return total, true
+	}
+
+	return elapsed, hasElapsed
+}
@@ -0,0 +1,239 @@
+package acpl
+
+import (
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/notnil/chess"
+)
+
+// EvalExtractor reads the eval of the position after a move from the move's comment.
+// Evals are in centipawns from White's perspective.
+type EvalExtractor interface {
+	Extract(comment string) (float64, bool)
+}
+
+// LichessExtractor reads [%eval X] in pawns, as Lichess exports them, or [%cp X] in centipawns
+type LichessExtractor struct{}
+
+func (LichessExtractor) Extract(comment string) (float64, bool) {
+	return parseEval(comment)
+}
+
+// CentipawnExtractor only reads [%cp X] annotations
+type CentipawnExtractor struct{}
+
+func (CentipawnExtractor) Extract(comment string) (float64, bool) {
+	s, ok := annotationValue(comment, "%cp ")
+	if !ok {
+		return 0, false
+	}
+
+	s, _, _ = strings.Cut(s, ",")
+	return parseNumber(s)
+}
+
+// WDLExtractor reads [%wdl W D L] annotations, in per mille from White's perspective as engines
+// such as Stockfish and Leela report them. The expected score is converted back to centipawns
+// with the inverse of WinPercent.
+type WDLExtractor struct{}
+
+func (WDLExtractor) Extract(comment string) (float64, bool) {
+	i := strings.Index(comment, "%wdl ")
+	if i == -1 {
+		return 0, false
+	}
+
+	s := comment[i+len("%wdl "):]
+	if end := strings.Index(s, "]"); end >= 0 {
+		s = s[:end]
+	}
+
+	fields := strings.Fields(s)
+	if len(fields) != 3 {
+		return 0, false
+	}
+
+	var wdl [3]float64
+	for j, f := range fields {
+		v, ok := parseNumber(f)
+		if !ok || v < 0 {
+			return 0, false
+		}
+		wdl[j] = v
+	}
+
+	total := wdl[0] + wdl[1] + wdl[2]
+	if total == 0 || math.IsInf(total, 0) {
+		return 0, false
+	}
+
+	winPercent := 100 * (wdl[0] + wdl[1]/2) / total
+
+	// keep decided positions finite
+	winPercent = max(0.1, min(99.9, winPercent))
+
+	return -math.Log(100/winPercent-1) / DefaultWinSteepness, true
+}
+
+// EvalProvider evaluates a position given as FEN, in centipawns from White's perspective.
+// It lets an engine fill in evals for games Lichess has not analysed.
+type EvalProvider interface {
+	Evaluate(fen string) (float64, bool)
+}
+
+// plyEval is the eval after a ply, only set when ok
+type plyEval struct {
+	cp float64
+	ok bool
+}
+
+// plyEvals returns the eval after each ply, read from the annotations or, when the game has none
+// and opts.Provider is set, from the provider
+func (opts Options) plyEvals(game *chess.Game) []plyEval {
+	moves := game.Moves()
+	comments := game.Comments()
+	evals := make([]plyEval, len(moves))
+	annotated := false
+
+	for i := 0; i < len(moves) && i < len(comments); i++ {
+		if len(comments[i]) == 0 {
+			continue
+		}
+
+		// use last comment for the move
+		cp, ok := opts.extractor().Extract(comments[i][len(comments[i])-1])
+		evals[i] = plyEval{cp, ok}
+		annotated = annotated || ok
+	}
+
+	if annotated || opts.Provider == nil {
+		return evals
+	}
+
+	positions := game.Positions()
+	for i := range moves {
+		if i+1 < len(positions) {
+			cp, ok := opts.Provider.Evaluate(positions[i+1].String())
+			evals[i] = plyEval{cp, ok}
+		}
+	}
+
+	return evals
+}
+
+// Evals returns the known evals after each ply, in centipawns from White's perspective, keyed by ply
+func Evals(game *chess.Game, opts Options) map[int]float64 {
+	evals := make(map[int]float64)
+
+	for i, e := range opts.plyEvals(game) {
+		if e.ok {
+			evals[i] = e.cp
+		}
+	}
+
+	return evals
+}
+
+// Analysable reports whether any of the game's moves has an eval, so that ACPL can be computed
+func Analysable(game *chess.Game, opts Options) bool {
+	for _, e := range opts.plyEvals(game) {
+		if e.ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (opts Options) extractor() EvalExtractor {
+	if opts.Extractor == nil {
+		return LichessExtractor{}
+	}
+
+	return opts.Extractor
+}
+
+// annotationValue returns the token following key in comment, e.g. "+0.35" for "[%eval +0.35]"
+func annotationValue(comment string, key string) (string, bool) {
+	i := strings.Index(comment, key)
+	if i == -1 {
+		return "", false
+	}
+
+	s := strings.TrimLeft(comment[i+len(key):], " \t")
+
+	end := strings.IndexAny(s, " \t]")
+	if end >= 0 {
+		s = s[:end]
+	}
+
+	if s == "" {
+		return "", false
+	}
+
+	return s, true
+}
+
+// parseNumber parses a finite decimal number, rejecting forms ParseFloat accepts but
+// annotations never contain, such as "NaN", "Inf" or hexadecimal floats
+func parseNumber(s string) (float64, bool) {
+	if strings.ContainsAny(s, "xXnN_") {
+		return 0, false
+	}
+
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, false
+	}
+
+	return v, true
+}
+
+// normalizeDecimal turns a locale comma decimal such as "0,35" into "0.35". When the value already
+// has a decimal point, as in "0.35,23" (eval and depth), the comma separates fields and is cut instead.
+func normalizeDecimal(s string) string {
+	if strings.HasPrefix(s, "#") || strings.Contains(s, ".") {
+		s, _, _ = strings.Cut(s, ",")
+		return s
+	}
+
+	return strings.Replace(s, ",", ".", 1)
+}
+
+// parse [%eval X] (pawns) or [%cp X] (centipawns) from comment
+func parseEval(comment string) (float64, bool) {
+	if s, ok := annotationValue(comment, "%eval "); ok {
+		s = normalizeDecimal(s)
+
+		// Lichess formats mates like: "#3", "#-1"
+		if mate, ok := strings.CutPrefix(s, "#"); ok {
+			moves, err := strconv.Atoi(mate)
+			if err != nil {
+				return 0, false
+			}
+
+			// check sign
+			if moves < 0 || strings.HasPrefix(mate, "-") {
+				return -1000, true
+			}
+			return 1000, true
+		}
+
+		v, ok := parseNumber(s)
+		if !ok || math.IsInf(v*100, 0) {
+			return 0, false
+		}
+
+		return v * 100, true // convert to centipawns
+	}
+
+	if s, ok := annotationValue(comment, "%cp "); ok {
+		// centipawns are whole numbers, so a comma can only separate fields
+		s, _, _ = strings.Cut(s, ",")
+		return parseNumber(s)
+	}
+
+	return 0, false
+}
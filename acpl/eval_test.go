@@ -0,0 +1,205 @@
+package acpl
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseEval(t *testing.T) {
+	tests := []struct {
+		comment string
+		want    float64
+		ok      bool
+	}{
+		{"[%eval 0.35]", 35, true},
+		{"[%eval -1.2] [%clk 0:03:00]", -120, true},
+		{"[%clk 0:03:00] [%eval 2]", 200, true},
+		{"[%eval 0,35]", 35, true},
+		{"[%eval 0.35,23]", 35, true},
+		{"[%eval #3]", 1000, true},
+		{"[%eval #-1]", -1000, true},
+		{"[%eval #-0]", -1000, true},
+		{"[%cp 42]", 42, true},
+		{"[%cp -17,20]", -17, true},
+		{"[%clk 0:03:00]", 0, false},
+		{"", 0, false},
+		{"[%eval ]", 0, false},
+		{"[%eval #]", 0, false},
+		{"[%eval #x]", 0, false},
+		{"[%eval NaN]", 0, false},
+		{"[%eval Inf]", 0, false},
+		{"[%eval 0x1p3]", 0, false},
+		{"[%eval 1_000]", 0, false},
+		{"[%eval 1e400]", 0, false},
+		{"[%eval 1e307]", 0, false},
+		{"[%eval #99999999999999999999]", 0, false},
+		{"[%cp nan]", 0, false},
+	}
+
+	for _, tt := range tests {
+		got, ok := parseEval(tt.comment)
+		if ok != tt.ok || (ok && got != tt.want) {
+			t.Errorf("parseEval(%q) = %v, %v, want %v, %v", tt.comment, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func FuzzParseEval(f *testing.F) {
+	for _, seed := range []string{
+		"[%eval 0.35]",
+		"[%eval #-2]",
+		"[%cp 42]",
+		"[%eval 0,35]",
+		"[%eval x]",
+		"[%eval X1]",
+		"[%eval NaN]",
+		"[%eval -Inf]",
+		"[%eval 1_0]",
+		"[%eval #]",
+		"[%eval #-]",
+		"[%eval 1e309]",
+		"[%eval 1e307]",
+		"[%cp 99999999999999999999999999999999999999999999999999e300]",
+		"[%eval #99999999999999999999]",
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, comment string) {
+		v, ok := parseEval(comment)
+		if !ok {
+			return
+		}
+
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			t.Errorf("parseEval(%q) = %v, want a finite eval", comment, v)
+		}
+	})
+}
+
+func TestExtractors(t *testing.T) {
+	tests := []struct {
+		name      string
+		extractor EvalExtractor
+		comment   string
+		want      float64
+		ok        bool
+	}{
+		{"lichess eval", LichessExtractor{}, "[%eval 0.35]", 35, true},
+		{"lichess cp", LichessExtractor{}, "[%cp 40]", 40, true},
+		{"cp", CentipawnExtractor{}, "[%cp -120]", -120, true},
+		{"cp with depth", CentipawnExtractor{}, "[%cp 35,20]", 35, true},
+		{"cp ignores eval", CentipawnExtractor{}, "[%eval 0.35]", 0, false},
+		{"cp not a number", CentipawnExtractor{}, "[%cp NaN]", 0, false},
+		{"wdl ignores eval", WDLExtractor{}, "[%eval 0.35]", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := tt.extractor.Extract(tt.comment)
+			if got != tt.want || ok != tt.ok {
+				t.Errorf("Extract(%q) = %v, %v, want %v, %v", tt.comment, got, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
+
+func TestWDLExtractor(t *testing.T) {
+	tests := []struct {
+		comment    string
+		winPercent float64
+		ok         bool
+	}{
+		{"[%wdl 500 0 500]", 50, true},
+		{"[%wdl 600 300 100]", 75, true},
+		{"[%wdl 0 1000 0]", 50, true},
+		// decided positions stay finite
+		{"[%wdl 1000 0 0]", 99.9, true},
+		{"[%wdl 0 0 1000]", 0.1, true},
+		{"[%wdl 0 0 0]", 0, false},
+		{"[%wdl 500 500]", 0, false},
+		{"[%wdl -1 500 501]", 0, false},
+		{"[%wdl 500 0 Inf]", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.comment, func(t *testing.T) {
+			cp, ok := WDLExtractor{}.Extract(tt.comment)
+			if ok != tt.ok {
+				t.Fatalf("Extract(%q) ok = %v, want %v", tt.comment, ok, tt.ok)
+			}
+
+			// the centipawns convert back to the expected score
+			if got := WinPercent(cp, DefaultWinSteepness); ok && math.Abs(got-tt.winPercent) > 1e-9 {
+				t.Errorf("Extract(%q) = %v, which is %v%%, want %v%%", tt.comment, cp, got, tt.winPercent)
+			}
+		})
+	}
+}
+
+// stubProvider evaluates the positions it knows, counting every call
+type stubProvider struct {
+	evals map[string]float64
+	calls int
+}
+
+func (p *stubProvider) Evaluate(fen string) (float64, bool) {
+	p.calls++
+	eval, ok := p.evals[fen]
+	return eval, ok
+}
+
+func TestProvider(t *testing.T) {
+	annotated, err := ParseGame(strings.NewReader(testPGN("annotated", "alice", "bob", testMoves)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the provider knows the evals testMoves are annotated with
+	provider := &stubProvider{evals: map[string]float64{}}
+	positions := annotated.Positions()
+	for ply, eval := range Evals(annotated, Options{}) {
+		provider.evals[positions[ply+1].String()] = eval
+	}
+
+	bare := regexp.MustCompile(` ?\{[^}]*\}`).ReplaceAllString(testMoves, "")
+	pgn := testPGN("bare", "alice", "bob", bare) + "\n\n" + testPGN("annotated", "alice", "bob", testMoves)
+
+	tests := []struct {
+		name  string
+		opts  Options
+		want  []string
+		calls int
+	}{
+		{"without a provider", Options{}, []string{"annotated 25"}, 0},
+		// only the unannotated game's eight positions are asked for
+		{"with a provider", Options{Provider: provider}, []string{"bare 25", "annotated 25"}, 8},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider.calls = 0
+
+			results, err := RankByACPL(strings.NewReader(pgn), "alice", tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, r := range results {
+				got = append(got, fmt.Sprintf("%s %g", GameKey(r.Game), r.ACPL))
+			}
+
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("ranked %v, want %v", got, tt.want)
+			}
+			if provider.calls != tt.calls {
+				t.Errorf("provider called %d times, want %d", provider.calls, tt.calls)
+			}
+		})
+	}
+}
@@ -0,0 +1,448 @@
+package acpl
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/notnil/chess"
+)
+
+// Filter decides which games are ranked, given the side the player had
+type Filter interface {
+	Keep(game *chess.Game, isWhite bool) bool
+	// Describe completes "Filters: ..." on the results page
+	Describe() string
+}
+
+// evalFilter is a Filter that reads the game's evals. Options.keep calls keepEvaluated with the options
+// being ranked with, so that the evals come from the same Extractor and Provider as the losses do.
+type evalFilter interface {
+	keepEvaluated(game *chess.Game, isWhite bool, opts Options) bool
+}
+
+// ParseElo reads a WhiteElo or BlackElo tag. Lichess suffixes provisional ratings with "?".
+func ParseElo(tag string) (elo int, provisional bool, ok bool) {
+	tag, provisional = strings.CutSuffix(strings.TrimSpace(tag), "?")
+
+	elo, err := strconv.Atoi(tag)
+	if err != nil || elo <= 0 {
+		return 0, false, false
+	}
+
+	return elo, provisional, true
+}
+
+// RatingChange returns the rating points the player gained or lost in the game, from the WhiteRatingDiff or
+// BlackRatingDiff tag. Casual games have no such tag.
+func RatingChange(game *chess.Game, isWhite bool) (int, bool) {
+	tag := "BlackRatingDiff"
+	if isWhite {
+		tag = "WhiteRatingDiff"
+	}
+
+	change, err := strconv.Atoi(strings.TrimSpace(TagValue(game, tag)))
+	if err != nil {
+		return 0, false
+	}
+
+	return change, true
+}
+
+// Ratings returns the player's and the opponent's ratings
+func Ratings(game *chess.Game, isWhite bool) (player int, opponent int, ok bool) {
+	white, _, okWhite := ParseElo(TagValue(game, "WhiteElo"))
+	black, _, okBlack := ParseElo(TagValue(game, "BlackElo"))
+
+	if !okWhite || !okBlack {
+		return 0, 0, false
+	}
+
+	if isWhite {
+		return white, black, true
+	}
+	return black, white, true
+}
+
+// Established drops games the player played while their rating was provisional, which Lichess marks with
+// a "?" after it. Games without the player's rating are kept.
+type Established struct{}
+
+func (f Established) Keep(game *chess.Game, isWhite bool) bool {
+	tag := "BlackElo"
+	if isWhite {
+		tag = "WhiteElo"
+	}
+
+	_, provisional, _ := ParseElo(TagValue(game, tag))
+	return !provisional
+}
+
+func (f Established) Describe() string {
+	return "no games played on a provisional rating"
+}
+
+// NotFlagged drops games the player lost on time while clearly winning, see FlaggedWhileWinning. Their
+// ACPL can be low without the player having done anything wrong but run out of time.
+type NotFlagged struct{}
+
+func (f NotFlagged) Keep(game *chess.Game, isWhite bool) bool {
+	return f.keepEvaluated(game, isWhite, Options{})
+}
+
+func (f NotFlagged) keepEvaluated(game *chess.Game, isWhite bool, opts Options) bool {
+	return !FlaggedWhileWinning(game, isWhite, opts)
+}
+
+func (f NotFlagged) Describe() string {
+	return "no games lost on time while winning"
+}
+
+// MinBaseTime keeps games whose clocks started with at least Seconds. Games without a clock,
+// which Lichess tags "-" for correspondence and unlimited games, are kept; games whose
+// TimeControl cannot be read are dropped.
+type MinBaseTime struct {
+	Seconds int
+}
+
+func (f MinBaseTime) Keep(game *chess.Game, isWhite bool) bool {
+	tag := TagValue(game, "TimeControl")
+	if tag == "-" {
+		return true
+	}
+
+	base, _, ok := ParseTimeControl(tag)
+	return ok && base >= f.Seconds
+}
+
+func (f MinBaseTime) Describe() string {
+	if f.Seconds%60 == 0 {
+		return fmt.Sprintf("only games with at least %d minutes on the clock", f.Seconds/60)
+	}
+	return fmt.Sprintf("only games with at least %d seconds on the clock", f.Seconds)
+}
+
+// MinDuration keeps games in which both players spent at least Min on the clock together, as
+// read by GameDuration. Games without clock data are kept only when KeepUnknown is set.
+type MinDuration struct {
+	Min         time.Duration
+	KeepUnknown bool
+}
+
+func (f MinDuration) Keep(game *chess.Game, isWhite bool) bool {
+	duration, ok := GameDuration(game)
+	if !ok {
+		return f.KeepUnknown
+	}
+	return duration >= f.Min
+}
+
+func (f MinDuration) Describe() string {
+	return fmt.Sprintf("only games lasting at least %d minutes", int(f.Min.Minutes()))
+}
+
+// IsBot reports whether the player with White, or Black when isWhite is false, is a Lichess bot account.
+// Games without a title tag are taken to be against humans.
+func IsBot(game *chess.Game, isWhite bool) bool {
+	tag := "BlackTitle"
+	if isWhite {
+		tag = "WhiteTitle"
+	}
+	return TagValue(game, tag) == "BOT"
+}
+
+// Bots keeps only games against bot accounts when Only is set, and otherwise only games against humans
+type Bots struct {
+	Only bool
+}
+
+func (f Bots) Keep(game *chess.Game, isWhite bool) bool {
+	return IsBot(game, !isWhite) == f.Only
+}
+
+func (f Bots) Describe() string {
+	if f.Only {
+		return "only games against bots"
+	}
+	return "no games against bots"
+}
+
+// ExcludeOpponents drops games against any of Names, compared case-insensitively
+type ExcludeOpponents struct {
+	Names []string
+}
+
+func (f ExcludeOpponents) Keep(game *chess.Game, isWhite bool) bool {
+	opponent := TagValue(game, "Black")
+	if !isWhite {
+		opponent = TagValue(game, "White")
+	}
+
+	for _, name := range f.Names {
+		if strings.EqualFold(name, opponent) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (f ExcludeOpponents) Describe() string {
+	return "excluding games against " + strings.Join(f.Names, ", ")
+}
+
+// Saves keeps games the player won after facing an eval of at least Threshold centipawns against them
+type Saves struct {
+	Threshold float64
+}
+
+func (f Saves) Keep(game *chess.Game, isWhite bool) bool {
+	return f.keepEvaluated(game, isWhite, Options{})
+}
+
+func (f Saves) keepEvaluated(game *chess.Game, isWhite bool, opts Options) bool {
+	if !Won(game, isWhite) {
+		return false
+	}
+
+	lowest, _, ok := LowestEval(game, isWhite, opts)
+	return ok && lowest <= -f.Threshold
+}
+
+func (f Saves) Describe() string {
+	return fmt.Sprintf("only games won after being %.0f centipawns down", f.Threshold)
+}
+
+// Color keeps games the player played as White, or as Black when White is false
+type Color struct {
+	White bool
+}
+
+func (f Color) Keep(game *chess.Game, isWhite bool) bool {
+	return isWhite == f.White
+}
+
+func (f Color) Describe() string {
+	if f.White {
+		return "only games as White"
+	}
+	return "only games as Black"
+}
+
+// OpeningFamily keeps games whose Opening tag is Name or one of its variations, ignoring case, e.g.
+// "French Defense" keeps "French Defense: Winawer Variation"
+type OpeningFamily struct {
+	Name string
+}
+
+func (f OpeningFamily) Keep(game *chess.Game, isWhite bool) bool {
+	opening, found := strings.CutPrefix(strings.ToLower(TagValue(game, "Opening")), strings.ToLower(f.Name))
+	return found && (opening == "" || opening[0] == ':' || opening[0] == ',')
+}
+
+func (f OpeningFamily) Describe() string {
+	return "only the " + f.Name
+}
+
+// Wins keeps games the player won
+type Wins struct{}
+
+func (f Wins) Keep(game *chess.Game, isWhite bool) bool {
+	return Won(game, isWhite)
+}
+
+func (f Wins) Describe() string {
+	return "only won games"
+}
+
+// MinRating keeps games where the player was rated at least Elo. Games missing the player's rating are dropped.
+type MinRating struct {
+	Elo int
+}
+
+func (f MinRating) Keep(game *chess.Game, isWhite bool) bool {
+	tag := "BlackElo"
+	if isWhite {
+		tag = "WhiteElo"
+	}
+
+	elo, _, ok := ParseElo(TagValue(game, tag))
+	return ok && elo >= f.Elo
+}
+
+func (f MinRating) Describe() string {
+	return fmt.Sprintf("only games played while rated at least %d", f.Elo)
+}
+
+// Phase keeps games that reached move Move, e.g. to study endgames, or with Before, games decided before it.
+// A game reaches a move once White plays it.
+type Phase struct {
+	Move   int
+	Before bool
+}
+
+func (f Phase) Keep(game *chess.Game, isWhite bool) bool {
+	reached := len(game.Moves()) >= 2*f.Move-1
+	return reached != f.Before
+}
+
+func (f Phase) Describe() string {
+	if f.Before {
+		return fmt.Sprintf("only games decided before move %d", f.Move)
+	}
+	return fmt.Sprintf("only games reaching move %d", f.Move)
+}
+
+// Terminations keeps games whose Termination tag, such as "Normal" or "Time forfeit", is one of Values,
+// or with Exclude, is none of them. Games without the tag are only kept when excluding.
+type Terminations struct {
+	Values  []string
+	Exclude bool
+}
+
+func (f Terminations) Keep(game *chess.Game, isWhite bool) bool {
+	termination := TagValue(game, "Termination")
+	if termination == "" {
+		return f.Exclude
+	}
+
+	for _, v := range f.Values {
+		if strings.EqualFold(v, termination) {
+			return !f.Exclude
+		}
+	}
+
+	return f.Exclude
+}
+
+func (f Terminations) Describe() string {
+	values := strings.ToLower(strings.Join(f.Values, " or "))
+	if f.Exclude {
+		return "excluding games whose termination is " + values
+	}
+	return "only games whose termination is " + values
+}
+
+// Upsets keeps games against opponents rated at least Margin points above the player.
+// Games missing either rating are dropped.
+type Upsets struct {
+	Margin int
+}
+
+func (f Upsets) Keep(game *chess.Game, isWhite bool) bool {
+	player, opponent, ok := Ratings(game, isWhite)
+	return ok && opponent-player >= f.Margin
+}
+
+func (f Upsets) Describe() string {
+	if f.Margin == 0 {
+		return "only games against equal or higher-rated opponents"
+	}
+	return fmt.Sprintf("only games against opponents rated at least %d points higher", f.Margin)
+}
+
+// moveNumber matches the move numbers of a line such as "1. e4 c5 2. Nf3", including "1..." and "1.e4"
+var moveNumber = regexp.MustCompile(`^\d+\.+`)
+
+// Line keeps games that opened with Moves, or with Transpositions, games reaching the position after
+// Moves by any move order. Build it with ParseLine.
+type Line struct {
+	// Moves are in algebraic notation, e.g. "e4", "c5", "Nf3"
+	Moves          []string
+	Transpositions bool
+	uci            []string
+	position       string
+}
+
+// ParseLine reads a move sequence from the starting position, such as "1. e4 c5 2. Nf3 d6"
+func ParseLine(text string, transpositions bool) (Line, error) {
+	line := Line{Transpositions: transpositions}
+	pos := chess.StartingPosition()
+
+	for token := range strings.FieldsSeq(text) {
+		token = moveNumber.ReplaceAllString(token, "")
+		if token == "" {
+			continue
+		}
+
+		move, err := chess.AlgebraicNotation{}.Decode(pos, token)
+		if err != nil && len(line.Moves) == 0 {
+			return Line{}, fmt.Errorf("%s is not a legal first move", token)
+		}
+		if err != nil {
+			return Line{}, fmt.Errorf("%s is not a legal move after %s", token, line)
+		}
+
+		line.Moves = append(line.Moves, chess.AlgebraicNotation{}.Encode(pos, move))
+		line.uci = append(line.uci, move.String())
+		pos = pos.Update(move)
+	}
+
+	if len(line.Moves) == 0 {
+		return Line{}, fmt.Errorf("no moves in %q", text)
+	}
+
+	line.position = positionKey(pos)
+	return line, nil
+}
+
+// positionKey identifies a position regardless of the move counters and en passant square, which this
+// library sets after any double pawn push, so that transpositions compare equal
+func positionKey(pos *chess.Position) string {
+	return fmt.Sprintf("%s %s %s", pos.Board(), pos.Turn(), pos.CastleRights())
+}
+
+// String numbers the moves, e.g. "1. e4 c5 2. Nf3"
+func (f Line) String() string {
+	var b strings.Builder
+
+	for i, m := range f.Moves {
+		if i > 0 {
+			b.WriteString(" ")
+		}
+		if i%2 == 0 {
+			fmt.Fprintf(&b, "%d. ", i/2+1)
+		}
+		b.WriteString(m)
+	}
+
+	return b.String()
+}
+
+func (f Line) Keep(game *chess.Game, isWhite bool) bool {
+	moves := game.Moves()
+
+	if len(moves) >= len(f.uci) {
+		followed := true
+		for i, uci := range f.uci {
+			if moves[i].String() != uci {
+				followed = false
+				break
+			}
+		}
+		if followed {
+			return true
+		}
+	}
+
+	if !f.Transpositions {
+		return false
+	}
+
+	for _, pos := range game.Positions() {
+		if positionKey(pos) == f.position {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (f Line) Describe() string {
+	if f.Transpositions {
+		return "only games reaching the position after " + f.String()
+	}
+	return "only games opening with " + f.String()
+}
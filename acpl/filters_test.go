@@ -0,0 +1,81 @@
+package acpl
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// scholarsMate are the seven plies of White mating on f7
+var scholarsMate = strings.Fields("e4 e5 Qh5 Nc6 Bc4 Nf6 Qxf7#")
+
+// wdlMoves are the first plies of scholarsMate, one per [%wdl W D L] annotation as an engine other than
+// Lichess's writes them
+func wdlMoves(wdls ...string) string {
+	var moves strings.Builder
+
+	for i, m := range scholarsMate[:len(wdls)] {
+		if i%2 == 0 {
+			fmt.Fprintf(&moves, "%d. ", i/2+1)
+		} else {
+			fmt.Fprintf(&moves, "%d... ", i/2+1)
+		}
+		fmt.Fprintf(&moves, "%s { [%%wdl %s] } ", m, wdls[i])
+	}
+
+	return strings.TrimSpace(moves.String())
+}
+
+func TestSavesReadsRankedEvals(t *testing.T) {
+	const even, lost, won = "300 400 300", "10 90 900", "900 90 10"
+
+	pgn := strings.Join([]string{
+		// alice's queen sortie leaves her lost, about -5, until bob misses the mate on f7
+		testPGN("saved", "alice", "bob", wdlMoves(even, even, lost, lost, lost, won, won)),
+		testPGN("steady", "alice", "bob", wdlMoves(even, even, even, even, even, won, won)),
+	}, "\n\n")
+
+	opts := Options{Extractor: WDLExtractor{}, Filters: []Filter{Saves{Threshold: 400}}}
+
+	results, err := RankByACPL(strings.NewReader(pgn), "alice", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, r := range results {
+		got = append(got, GameKey(r.Game))
+	}
+
+	if want := []string{"saved"}; !slices.Equal(got, want) {
+		t.Errorf("ranked %v, want %v", got, want)
+	}
+}
+
+func TestNotFlaggedReadsRankedEvals(t *testing.T) {
+	const even, lost, won = "300 400 300", "10 90 900", "900 90 10"
+
+	// alice, as White, runs out of time before playing Qxf7#
+	flagged := strings.NewReplacer("1-0", "0-1", `"Normal"`, `"Time forfeit"`)
+
+	pgn := strings.Join([]string{
+		flagged.Replace(testPGN("winning", "alice", "bob", wdlMoves(even, even, even, even, even, won))),
+		flagged.Replace(testPGN("losing", "alice", "bob", wdlMoves(even, even, lost, lost, lost, lost))),
+	}, "\n\n")
+	opts := Options{Extractor: WDLExtractor{}, Filters: []Filter{NotFlagged{}}}
+
+	results, err := RankByACPL(strings.NewReader(pgn), "alice", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, r := range results {
+		got = append(got, GameKey(r.Game))
+	}
+
+	if want := []string{"losing"}; !slices.Equal(got, want) {
+		t.Errorf("ranked %v, want %v", got, want)
+	}
+}
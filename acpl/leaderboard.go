@@ -0,0 +1,167 @@
+package acpl
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Standing is a player's average ACPL across the games of an event
+type Standing struct {
+	Player      string  `json:"player"`
+	Games       int     `json:"games"`
+	AverageACPL float64 `json:"averageAcpl"`
+	// InsufficientData is set by MinGames on players with too few games for their average to say much
+	InsufficientData bool `json:"insufficientData,omitempty"`
+}
+
+// sideACPL is the ACPL of one side of a game, keyed by the game so duplicates count once
+type sideACPL struct {
+	game   string
+	player string
+	acpl   float64
+}
+
+// Leaderboard ranks every player in the games read from r by the average of their games' ACPL, most
+// accurate first, with ties going to the player with more games. Games are analysed in parallel, so
+// that a large tournament does not take one core. Each side of a game is subject to opts as the player's
+// side is in RankByACPL.
+func Leaderboard(ctx context.Context, r io.Reader, opts Options) ([]Standing, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Split(splitPGN)
+
+	pgns := make(chan string)
+	sides := make(chan sideACPL)
+	scanErr := make(chan error, 1)
+
+	go func() {
+		defer close(pgns)
+
+		for scanner.Scan() {
+			select {
+			case pgns <- scanner.Text():
+			case <-ctx.Done():
+				scanErr <- ctx.Err()
+				return
+			}
+		}
+
+		scanErr <- scanner.Err()
+	}()
+
+	var wg sync.WaitGroup
+	for range runtime.GOMAXPROCS(0) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for pgn := range pgns {
+				for _, side := range gameSides(pgn, opts) {
+					sides <- side
+				}
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(sides)
+	}()
+
+	standings := make(map[string]*Standing)
+	seen := make(map[string]bool)
+
+	for side := range sides {
+		key := strings.ToLower(side.player)
+		if seen[side.game+"|"+key] {
+			continue // duplicate game
+		}
+		seen[side.game+"|"+key] = true
+
+		s, ok := standings[key]
+		if !ok {
+			s = &Standing{Player: side.player}
+			standings[key] = s
+		}
+
+		s.Games++
+		s.AverageACPL += side.acpl
+	}
+
+	if err := <-scanErr; err != nil {
+		return nil, err
+	}
+
+	out := make([]Standing, 0, len(standings))
+	for _, s := range standings {
+		s.AverageACPL /= float64(s.Games)
+		out = append(out, *s)
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].AverageACPL != out[j].AverageACPL {
+			return out[i].AverageACPL < out[j].AverageACPL
+		}
+		if out[i].Games != out[j].Games {
+			return out[i].Games > out[j].Games
+		}
+		return out[i].Player < out[j].Player
+	})
+
+	return out, nil
+}
+
+// MinGames marks the standings of players with fewer than minGames games as having insufficient data and
+// ranks them after everyone else, in the same order among themselves. Unlike a stats.Bucket, their average
+// is kept so that they can still be told apart.
+func MinGames(standings []Standing, minGames int) []Standing {
+	for i := range standings {
+		standings[i].InsufficientData = standings[i].Games < minGames
+	}
+
+	sort.SliceStable(standings, func(i, j int) bool {
+		return !standings[i].InsufficientData && standings[j].InsufficientData
+	})
+
+	return standings
+}
+
+// gameSides returns the ACPL of each side of the game in pgn that opts lets through
+func gameSides(pgn string, opts Options) []sideACPL {
+	if strings.TrimSpace(pgn) == "" {
+		return nil
+	}
+
+	game, err := ParseGame(strings.NewReader(pgn))
+	if err != nil || opts.tooShort(game) {
+		return nil
+	}
+
+	evals := opts.plyEvals(game)
+
+	if opts.ExcludeSuspect && suspectReason(evals) != "" {
+		return nil
+	}
+
+	var sides []sideACPL
+
+	for _, isWhite := range []bool{true, false} {
+		player := TagValue(game, "Black")
+		if isWhite {
+			player = TagValue(game, "White")
+		}
+
+		if player == "" || !opts.keep(game, isWhite) {
+			continue
+		}
+
+		if acpl, ok := averageLoss(sideLosses(game, evals, isWhite, opts), opts); ok {
+			sides = append(sides, sideACPL{game: GameKey(game), player: player, acpl: acpl})
+		}
+	}
+
+	return sides
+}
@@ -0,0 +1,26 @@
+package acpl
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestMinGames(t *testing.T) {
+	standings := []Standing{
+		{Player: "carol", Games: 1, AverageACPL: 10},
+		{Player: "alice", Games: 3, AverageACPL: 20},
+		{Player: "dave", Games: 2, AverageACPL: 25},
+		{Player: "bob", Games: 5, AverageACPL: 30},
+	}
+
+	want := []Standing{
+		{Player: "alice", Games: 3, AverageACPL: 20},
+		{Player: "bob", Games: 5, AverageACPL: 30},
+		{Player: "carol", Games: 1, AverageACPL: 10, InsufficientData: true},
+		{Player: "dave", Games: 2, AverageACPL: 25, InsufficientData: true},
+	}
+
+	if got := MinGames(standings, 3); !slices.Equal(got, want) {
+		t.Errorf("MinGames() = %v, want %v", got, want)
+	}
+}
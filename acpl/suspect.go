@@ -0,0 +1,76 @@
+package acpl
+
+import (
+	"math"
+
+	"github.com/notnil/chess"
+)
+
+// Reasons Suspect gives for a game's evals looking corrupted
+const (
+	SuspectConstant = "constant evals"
+	SuspectErratic  = "evals swinging on most moves"
+)
+
+// suspectMinEvals is how many evaluated plies a game needs before its evals are judged
+const suspectMinEvals = 10
+
+// suspectSwing is the change in eval, in centipawns, between consecutive plies that counts as a swing.
+// Evals are clamped to ±1000 first, so that mates found and lost do not count.
+const suspectSwing = 500
+
+// Suspect returns why the game's evals look corrupted, or "" when they look plausible. They do when
+// every evaluated ply has the same eval, which an engine never reports over a real game, or when the
+// eval swings by suspectSwing on more than half of the consecutive evaluated plies, which even the
+// wildest games do not.
+func Suspect(game *chess.Game, opts Options) string {
+	return suspectReason(opts.plyEvals(game))
+}
+
+// suspectReason is Suspect over the game's evals
+func suspectReason(plies []plyEval) string {
+	var evals []float64
+	var prevPly int
+
+	swings, pairs := 0, 0
+
+	for i, e := range plies {
+		if !e.ok {
+			continue
+		}
+
+		eval := math.Max(-1000, math.Min(1000, e.cp))
+
+		if len(evals) > 0 && i-prevPly == 1 {
+			pairs++
+			if math.Abs(eval-evals[len(evals)-1]) >= suspectSwing {
+				swings++
+			}
+		}
+
+		evals = append(evals, eval)
+		prevPly = i
+	}
+
+	if len(evals) < suspectMinEvals {
+		return ""
+	}
+
+	constant := true
+	for _, e := range evals[1:] {
+		if e != evals[0] {
+			constant = false
+			break
+		}
+	}
+
+	if constant {
+		return SuspectConstant
+	}
+
+	if pairs >= suspectMinEvals && swings*2 > pairs {
+		return SuspectErratic
+	}
+
+	return ""
+}
@@ -0,0 +1,103 @@
+package acpl
+
+import (
+	"math"
+
+	"github.com/notnil/chess"
+)
+
+// turningPointMoves is how many of the player's moves either side of a turning point are averaged
+const turningPointMoves = 5
+
+// TurningPoint is the ply after which the game was decided, with the player's ACPL over their moves
+// just before and just after it. Before and After are only set when HasBefore and HasAfter.
+type TurningPoint struct {
+	Ply int
+	// Swing is how far the eval moved on that ply, in centipawns
+	Swing     float64
+	Before    float64
+	HasBefore bool
+	After     float64
+	HasAfter  bool
+}
+
+// decisiveSide is 1 when eval is winning for White, -1 when it is winning for Black, and 0 otherwise
+func decisiveSide(eval float64) int {
+	switch {
+	case eval >= lostThreshold:
+		return 1
+	case eval <= -lostThreshold:
+		return -1
+	}
+	return 0
+}
+
+// FindTurningPoint finds the ply on which the eval became decisive for a side it was not decisive for
+// just before, taking the largest swing when there are several and the earliest on ties. It is not ok
+// for games that never became decisive. losses are the player's, as SideLosses returns them.
+func FindTurningPoint(game *chess.Game, losses []PlyLoss, opts Options) (TurningPoint, bool) {
+	return findTurningPoint(opts.plyEvals(game), losses)
+}
+
+// findTurningPoint is FindTurningPoint over the game's evals
+func findTurningPoint(evals []plyEval, losses []PlyLoss) (TurningPoint, bool) {
+	var (
+		turningPoint TurningPoint
+		found        bool
+		prevEval     float64
+		hasPrev      bool
+	)
+
+	for i, e := range evals {
+		if !e.ok {
+			hasPrev = false
+			continue
+		}
+
+		eval := max(-1000, min(1000, e.cp))
+
+		if hasPrev {
+			side := decisiveSide(eval)
+			swing := math.Abs(eval - prevEval)
+
+			if side != 0 && side != decisiveSide(prevEval) && (!found || swing > turningPoint.Swing) {
+				turningPoint, found = TurningPoint{Ply: i, Swing: swing}, true
+			}
+		}
+
+		prevEval, hasPrev = eval, true
+	}
+
+	if !found {
+		return TurningPoint{}, false
+	}
+
+	var before, after []PlyLoss
+	for _, l := range losses {
+		if l.Ply < turningPoint.Ply {
+			before = append(before, l)
+		} else if l.Ply > turningPoint.Ply && len(after) < turningPointMoves {
+			after = append(after, l)
+		}
+	}
+	before = before[max(0, len(before)-turningPointMoves):]
+
+	turningPoint.Before, turningPoint.HasBefore = meanLoss(before)
+	turningPoint.After, turningPoint.HasAfter = meanLoss(after)
+
+	return turningPoint, true
+}
+
+// meanLoss averages losses, or is not ok when there are none
+func meanLoss(losses []PlyLoss) (float64, bool) {
+	if len(losses) == 0 {
+		return 0, false
+	}
+
+	var total float64
+	for _, l := range losses {
+		total += l.Loss
+	}
+
+	return total / float64(len(losses)), true
+}
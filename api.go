@@ -0,0 +1,241 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log"
+	"macg/app/acpl"
+	"macg/app/stats"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type APIError struct {
+	Error string `json:"error"`
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	writeJSON(w, APIError{Error: message})
+}
+
+// retrieveForAPI ranks the games for the request's search, replying with a JSON error on failure
+func retrieveForAPI(w http.ResponseWriter, r *http.Request) ([]acpl.GameACPL, bool) {
+	search, ok := parseSearch(w, r)
+	if !ok {
+		return nil, false
+	}
+
+	results, err := search.retrieve(r.Context())
+
+	if err != nil {
+		log.Printf("Error retrieving results for %s: %v", r.RemoteAddr, err)
+		writeJSONError(w, errorStatus(err), friendlyError(err, "User not found."))
+		return nil, false
+	}
+
+	return results, true
+}
+
+// handleRank returns the most accurate games for a search, as /go does for JSON
+func handleRank(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Handling rank for %s", r.RemoteAddr)
+
+	results, ok := retrieveForAPI(w, r)
+	if !ok {
+		return
+	}
+
+	limit := min(len(results), maxResults)
+
+	setCacheHeaders(w)
+	writeJSON(w, slices.AppendSeq(make([]GameRow, 0, limit), rowSeq(results, limit, r.Form.Get("ties"))))
+}
+
+// handleSummary returns aggregate stats for a search without the per-game list
+func handleSummary(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Handling summary for %s", r.RemoteAddr)
+
+	results, ok := retrieveForAPI(w, r)
+	if !ok {
+		return
+	}
+
+	setCacheHeaders(w)
+	writeJSON(w, stats.Summarize(results, r.FormValue("aggregate"), minSampleGames))
+}
+
+// pickSurprise picks a random game among the top quarter of results, returning its rank
+func pickSurprise(results []acpl.GameACPL, rng *rand.Rand) (acpl.GameACPL, int, bool) {
+	if len(results) == 0 {
+		return acpl.GameACPL{}, 0, false
+	}
+
+	// round up so that users with fewer than four games still get one
+	top := (len(results) + 3) / 4
+	i := rng.IntN(top)
+
+	return results[i], i + 1, true
+}
+
+// handleLeaderboard ranks every player of the tournament parameter by their average ACPL in it. The
+// search's options apply, but not its username or time control.
+func handleLeaderboard(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Handling leaderboard for %s", r.RemoteAddr)
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxFormBytes)
+	if err := r.ParseForm(); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Bad request: "+err.Error())
+		return
+	}
+
+	kind, id, ok := parseTournament(r.Form.Get("tournament"))
+	if !ok {
+		writeJSONError(w, http.StatusBadRequest, "invalid tournament")
+		return
+	}
+
+	standings, err := retrieveTournamentField(r.Context(), kind, id, searchFromForm(r.Form).Options)
+
+	if err != nil {
+		log.Printf("Error retrieving leaderboard for %s: %v", r.RemoteAddr, err)
+		writeJSONError(w, errorStatus(err), friendlyError(err, "Tournament not found."))
+		return
+	}
+
+	setCacheHeaders(w)
+	// a player's average over a game or two says little, so they are marked like other small samples
+	writeJSON(w, acpl.MinGames(standings, minSampleGames))
+}
+
+// handleSurprise returns one random game from the user's most accurate ones. A seed parameter picks
+// the same game every time for the same games; otherwise the seed is the current time.
+func handleSurprise(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Handling surprise for %s", r.RemoteAddr)
+
+	results, ok := retrieveForAPI(w, r)
+	if !ok {
+		return
+	}
+
+	seed := uint64(time.Now().UnixNano())
+	if s := r.Form.Get("seed"); s != "" {
+		var err error
+		if seed, err = strconv.ParseUint(s, 10, 64); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "invalid seed")
+			return
+		}
+	}
+
+	rng := rand.New(rand.NewPCG(seed, 0))
+
+	game, rank, ok := pickSurprise(results, rng)
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "No games with computer analysis were found")
+		return
+	}
+
+	rank = tieRanks(results, rank, r.Form.Get("ties"))[rank-1]
+
+	setCacheHeaders(w)
+	writeJSON(w, buildRow(game, rank))
+}
+
+// handleLosses returns a histogram of the loss of every evaluated move across the user's games
+func handleLosses(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Handling losses for %s", r.RemoteAddr)
+
+	results, ok := retrieveForAPI(w, r)
+	if !ok {
+		return
+	}
+
+	setCacheHeaders(w)
+	writeJSON(w, stats.LossHistogram(results))
+}
+
+// handleTiming returns the user's average ACPL by UTC hour or, with by=weekday, by day of the week
+func handleTiming(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Handling timing for %s", r.RemoteAddr)
+
+	results, ok := retrieveForAPI(w, r)
+	if !ok {
+		return
+	}
+
+	buckets := stats.ByHour(results)
+	if r.FormValue("by") == "weekday" {
+		buckets = stats.ByWeekday(results)
+	}
+
+	setCacheHeaders(w)
+	writeJSON(w, stats.MinGames(buckets, minSampleGames))
+}
+
+// debugAPIKey guards /api/debug/scores, which is off when it is empty
+var debugAPIKey = os.Getenv("DEBUG_API_KEY")
+
+// ScoreRow is a ranked game reduced to what the ranking is checked against
+type ScoreRow struct {
+	GameId string  `json:"gameId"`
+	ACPL   float64 `json:"acpl"`
+}
+
+// authorizeDebug checks that DEBUG_API_KEY is set and sent as a bearer token, answering 404 when it is
+// not set and 401 when it is not sent
+func authorizeDebug(w http.ResponseWriter, r *http.Request) bool {
+	if debugAPIKey == "" {
+		http.NotFound(w, r)
+		return false
+	}
+
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(debugAPIKey)) != 1 {
+		writeJSONError(w, http.StatusUnauthorized, "invalid API key")
+		return false
+	}
+
+	return true
+}
+
+// handleDebugScores returns every ranked game of a search, in order and without the maxResults cap,
+// so that ranking and filtering can be checked without the display rows. It needs DEBUG_API_KEY, see
+// authorizeDebug.
+func handleDebugScores(w http.ResponseWriter, r *http.Request) {
+	if !authorizeDebug(w, r) {
+		return
+	}
+
+	log.Printf("Handling debug scores for %s", r.RemoteAddr)
+
+	results, ok := retrieveForAPI(w, r)
+	if !ok {
+		return
+	}
+
+	scores := make([]ScoreRow, 0, len(results))
+	for _, game := range results {
+		scores = append(scores, ScoreRow{GameId: acpl.GameKey(game.Game), ACPL: game.ACPL})
+	}
+
+	setCacheHeaders(w)
+	writeJSON(w, scores)
+}
+
+// handleDebugRecent lists the usernames searched most recently, hashed when the anonymize parameter is
+// true. It needs DEBUG_API_KEY, see authorizeDebug.
+func handleDebugRecent(w http.ResponseWriter, r *http.Request) {
+	if !authorizeDebug(w, r) {
+		return
+	}
+
+	log.Printf("Handling recent searches for %s", r.RemoteAddr)
+
+	setCacheHeaders(w)
+	writeJSON(w, recentSearches.List(r.FormValue("anonymize") == "true"))
+}
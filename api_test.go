@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"macg/app/acpl"
+	"macg/app/cache"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHandleSummary(t *testing.T) {
+	stubLichess(t, servePGN(t, "games.pgn"))
+
+	w := httptest.NewRecorder()
+	handleSummary(w, httptest.NewRequest(http.MethodGet, "/api/summary?username=alice&time_control=blitz", nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+	}
+
+	var summary map[string]any
+	if err := json.Unmarshal(w.Body.Bytes(), &summary); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, field := range []string{"games", "averageAcpl", "medianAcpl", "blunderRate", "accuracy"} {
+		if _, ok := summary[field]; !ok {
+			t.Errorf("summary has no %s: %s", field, w.Body)
+		}
+	}
+	if summary["games"] != 2.0 {
+		t.Errorf("games = %v, want 2", summary["games"])
+	}
+
+	// only aggregates, no list of games
+	for field, v := range summary {
+		if _, ok := v.([]any); ok {
+			t.Errorf("summary holds the array %s", field)
+		}
+	}
+}
+
+func TestHandleRankErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		lichess int
+		want    int
+	}{
+		{"user not found", http.StatusNotFound, http.StatusNotFound},
+		{"rate limited", http.StatusTooManyRequests, http.StatusTooManyRequests},
+		{"server error", http.StatusInternalServerError, http.StatusBadGateway},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stubLichess(t, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.lichess)
+			})
+
+			w := httptest.NewRecorder()
+			handleRank(w, httptest.NewRequest(http.MethodGet, "/api/rank?username=alice&time_control=blitz", nil))
+
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+
+			var body APIError
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body.Error == "" {
+				t.Errorf("body = %s, want a JSON error", w.Body)
+			}
+		})
+	}
+}
+
+func TestFetchCooldown(t *testing.T) {
+	tests := []struct {
+		name string
+		// between changes what the second search finds
+		between func()
+		status  int
+		fetches int32
+	}{
+		{
+			name:    "cached",
+			between: func() {},
+			status:  http.StatusOK,
+			fetches: 1,
+		},
+		{
+			name:    "cooling down",
+			between: func() { gamesCache = cache.NewCache[[]byte](time.Minute, 10) },
+			status:  http.StatusTooManyRequests,
+			fetches: 1,
+		},
+		{
+			name: "cooled down",
+			between: func() {
+				gamesCache = cache.NewCache[[]byte](time.Minute, 10)
+				time.Sleep(2 * fetchCooldown)
+			},
+			status:  http.StatusOK,
+			fetches: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var fetches atomic.Int32
+			games := servePGN(t, "games.pgn")
+			stubLichess(t, func(w http.ResponseWriter, r *http.Request) {
+				fetches.Add(1)
+				games(w, r)
+			})
+
+			previous := fetchCooldown
+			t.Cleanup(func() { fetchCooldown = previous })
+			fetchCooldown = 50 * time.Millisecond
+			fetchCooldowns = cache.NewCache[struct{}](fetchCooldown, 10)
+
+			search := func() *httptest.ResponseRecorder {
+				w := httptest.NewRecorder()
+				handleRank(w, httptest.NewRequest(http.MethodGet, "/api/rank?username=alice&time_control=blitz", nil))
+				return w
+			}
+
+			if w := search(); w.Code != http.StatusOK {
+				t.Fatalf("first search: status = %d, want 200", w.Code)
+			}
+
+			tt.between()
+
+			w := search()
+			if w.Code != tt.status {
+				t.Errorf("second search: status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if n := fetches.Load(); n != tt.fetches {
+				t.Errorf("fetched %d times, want %d", n, tt.fetches)
+			}
+		})
+	}
+}
+
+func TestHandleLeaderboard(t *testing.T) {
+	pgn, err := os.ReadFile(filepath.Join("testdata", "games.pgn"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the arena abcdEFGH and the Swiss ijklMNOP are the games in games.pgn
+	stubLichess(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/tournament/abcdEFGH/games", "/api/swiss/ijklMNOP/games":
+			w.Write(pgn)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+
+	// alice is the only player with as many games as minSampleGames, the others are still listed
+	previous := minSampleGames
+	t.Cleanup(func() { minSampleGames = previous })
+	minSampleGames = 2
+
+	tests := []struct {
+		name       string
+		tournament string
+		status     int
+		want       []string
+	}{
+		// the game against dave has no evals
+		{"arena", "https://lichess.org/tournament/abcdEFGH", http.StatusOK, []string{"alice 2 false", "carol 1 true", "bob 1 true"}},
+		{"swiss", "lichess.org/swiss/ijklMNOP", http.StatusOK, []string{"alice 2 false", "carol 1 true", "bob 1 true"}},
+		{"not found", "zzzzZZZZ", http.StatusNotFound, nil},
+		{"invalid", "lichess.org/tournament/abc", http.StatusBadRequest, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handleLeaderboard(w, httptest.NewRequest(http.MethodGet, "/api/leaderboard?tournament="+url.QueryEscape(tt.tournament), nil))
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+
+			var standings []acpl.Standing
+			if err := json.Unmarshal(w.Body.Bytes(), &standings); err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, s := range standings {
+				got = append(got, fmt.Sprintf("%s %d %v", s.Player, s.Games, s.InsufficientData))
+			}
+
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("standings = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+type entry[V any] struct {
+	key      string
+	value    V
+	storedAt time.Time
+}
+
+// Cache is a concurrency-safe map whose entries expire after ttl. When full, the least recently used
+// entry is evicted.
+type Cache[V any] struct {
+	mu         sync.Mutex
+	ttl        time.Duration
+	maxEntries int
+	entries    map[string]*list.Element
+	// recency orders the entries from the most recently used to the least
+	recency *list.List
+	now     func() time.Time
+}
+
+func NewCache[V any](ttl time.Duration, maxEntries int) *Cache[V] {
+	return &Cache[V]{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    make(map[string]*list.Element),
+		recency:    list.New(),
+		now:        time.Now,
+	}
+}
+
+// Get returns the value stored under key and when it was stored
+func (c *Cache[V]) Get(key string) (V, time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		var zero V
+		return zero, time.Time{}, false
+	}
+
+	e := el.Value.(*entry[V])
+
+	if c.now().Sub(e.storedAt) >= c.ttl {
+		c.remove(el)
+		var zero V
+		return zero, time.Time{}, false
+	}
+
+	c.recency.MoveToFront(el)
+	return e.value, e.storedAt, true
+}
+
+func (c *Cache[V]) Set(key string, value V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		el.Value = &entry[V]{key: key, value: value, storedAt: c.now()}
+		c.recency.MoveToFront(el)
+		return
+	}
+
+	if c.maxEntries <= 0 {
+		return
+	}
+
+	if len(c.entries) >= c.maxEntries {
+		c.remove(c.recency.Back())
+	}
+
+	c.entries[key] = c.recency.PushFront(&entry[V]{key: key, value: value, storedAt: c.now()})
+}
+
+// Delete drops the entry stored under key, if any
+func (c *Cache[V]) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+}
+
+func (c *Cache[V]) remove(el *list.Element) {
+	c.recency.Remove(el)
+	delete(c.entries, el.Value.(*entry[V]).key)
+}
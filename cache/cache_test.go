@@ -0,0 +1,134 @@
+package cache
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// clock is a settable time for the cache's now
+type clock struct {
+	t time.Time
+}
+
+func (c *clock) now() time.Time {
+	return c.t
+}
+
+func newTestCache(ttl time.Duration, maxEntries int) (*Cache[int], *clock) {
+	clk := &clock{t: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	c := NewCache[int](ttl, maxEntries)
+	c.now = clk.now
+	return c, clk
+}
+
+func TestGetExpired(t *testing.T) {
+	c, clk := newTestCache(time.Minute, 10)
+
+	c.Set("a", 1)
+
+	clk.t = clk.t.Add(59 * time.Second)
+	if v, storedAt, ok := c.Get("a"); !ok || v != 1 || !storedAt.Equal(clk.t.Add(-59*time.Second)) {
+		t.Errorf("Get before the ttl = %v, %v, %v, want 1 stored a minute ago", v, storedAt, ok)
+	}
+
+	clk.t = clk.t.Add(time.Second)
+	if _, _, ok := c.Get("a"); ok {
+		t.Error("Get after the ttl found the entry")
+	}
+}
+
+func TestSetEvictsOldest(t *testing.T) {
+	c, clk := newTestCache(time.Hour, 3)
+
+	for i, key := range []string{"a", "b", "c", "d"} {
+		clk.t = clk.t.Add(time.Second)
+		c.Set(key, i)
+	}
+
+	if _, _, ok := c.Get("a"); ok {
+		t.Error("the oldest entry was kept")
+	}
+	for _, key := range []string{"b", "c", "d"} {
+		if _, _, ok := c.Get(key); !ok {
+			t.Errorf("%s was evicted", key)
+		}
+	}
+}
+
+func TestGetKeepsRecentlyUsed(t *testing.T) {
+	c, _ := newTestCache(time.Hour, 3)
+
+	c.Set("a", 1)
+	c.Set("b", 2)
+	c.Set("c", 3)
+	c.Get("a")
+	c.Set("d", 4)
+
+	if _, _, ok := c.Get("b"); ok {
+		t.Error("the least recently used entry was kept")
+	}
+	for _, key := range []string{"a", "c", "d"} {
+		if _, _, ok := c.Get(key); !ok {
+			t.Errorf("%s was evicted", key)
+		}
+	}
+}
+
+func TestDelete(t *testing.T) {
+	c, _ := newTestCache(time.Hour, 2)
+
+	c.Set("a", 1)
+	c.Set("b", 2)
+	c.Delete("a")
+	c.Set("c", 3)
+
+	if _, _, ok := c.Get("a"); ok {
+		t.Error("a was kept after being deleted")
+	}
+	// deleting made room, so nothing else was evicted
+	if _, _, ok := c.Get("b"); !ok {
+		t.Error("b was evicted")
+	}
+}
+
+func TestSetReplacesWithoutEvicting(t *testing.T) {
+	c, _ := newTestCache(time.Hour, 2)
+
+	c.Set("a", 1)
+	c.Set("b", 2)
+	c.Set("a", 3)
+
+	if v, _, _ := c.Get("a"); v != 3 {
+		t.Errorf("a = %d, want 3", v)
+	}
+	if _, _, ok := c.Get("b"); !ok {
+		t.Error("replacing a evicted b")
+	}
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	c := NewCache[int](time.Hour, 50)
+
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range 200 {
+				key := strconv.Itoa((i + j) % 80)
+				c.Set(key, j)
+				c.Get(key)
+				if j%10 == 0 {
+					c.Delete(key)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := len(c.entries); n > 50 || n != c.recency.Len() {
+		t.Errorf("the cache holds %d entries and %d in its recency list, want the same at most 50", n, c.recency.Len())
+	}
+}
@@ -0,0 +1,171 @@
+package cache
+
+import (
+	"crypto/sha1"
+	"encoding/gob"
+	"encoding/hex"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Store is implemented by Cache and DiskCache
+type Store[V any] interface {
+	// Get returns the value stored under key and when it was stored
+	Get(key string) (V, time.Time, bool)
+	Set(key string, value V)
+}
+
+// diskEntry is what a cache file holds. Key is kept to tell apart keys whose hashes collide.
+type diskEntry[V any] struct {
+	Key      string
+	Value    V
+	StoredAt time.Time
+}
+
+// DiskCache is a Cache whose entries are gob files in a directory, so that they survive restarts.
+// Files that cannot be read are treated as missing and removed.
+type DiskCache[V any] struct {
+	mu         sync.Mutex
+	dir        string
+	ttl        time.Duration
+	maxEntries int
+	now        func() time.Time
+}
+
+// NewDiskCache creates dir if needed, and removes temporary files left behind by interrupted writes
+func NewDiskCache[V any](dir string, ttl time.Duration, maxEntries int) (*DiskCache[V], error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	tmps, _ := filepath.Glob(filepath.Join(dir, "*.tmp"))
+	for _, tmp := range tmps {
+		os.Remove(tmp)
+	}
+
+	return &DiskCache[V]{
+		dir:        dir,
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		now:        time.Now,
+	}, nil
+}
+
+// path names the file of key after its hash, as keys hold characters that are not valid in file names
+func (c *DiskCache[V]) path(key string) string {
+	sum := sha1.Sum([]byte(key))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:])+".gob")
+}
+
+func (c *DiskCache[V]) Get(key string) (V, time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var zero V
+
+	path := c.path(key)
+	e, err := readEntry[V](path)
+	if os.IsNotExist(err) {
+		return zero, time.Time{}, false
+	}
+	if err != nil {
+		log.Printf("Removing unreadable cache file %s: %v", path, err)
+		os.Remove(path)
+		return zero, time.Time{}, false
+	}
+
+	if e.Key != key {
+		return zero, time.Time{}, false
+	}
+
+	if c.now().Sub(e.StoredAt) >= c.ttl {
+		os.Remove(path)
+		return zero, time.Time{}, false
+	}
+
+	return e.Value, e.StoredAt, true
+}
+
+func (c *DiskCache[V]) Set(key string, value V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	path := c.path(key)
+
+	if _, err := os.Stat(path); err != nil {
+		c.evict(now)
+	}
+
+	// written to a temporary file first so that a crash cannot leave a partial entry behind
+	tmp, err := os.CreateTemp(c.dir, "*.tmp")
+	if err != nil {
+		log.Printf("Error caching %s: %v", key, err)
+		return
+	}
+
+	err = gob.NewEncoder(tmp).Encode(diskEntry[V]{Key: key, Value: value, StoredAt: now})
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		log.Printf("Error caching %s: %v", key, err)
+		os.Remove(tmp.Name())
+	}
+}
+
+// evict drops expired entries, or the oldest one if none have expired, once the cache is full. Files are
+// aged by their modification time, which is when they were stored, so that they need not be decoded.
+func (c *DiskCache[V]) evict(now time.Time) {
+	files, err := filepath.Glob(filepath.Join(c.dir, "*.gob"))
+	if err != nil || len(files) < c.maxEntries {
+		return
+	}
+
+	var (
+		oldestPath string
+		oldest     time.Time
+		expired    bool
+	)
+
+	for _, path := range files {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+
+		if now.Sub(info.ModTime()) >= c.ttl {
+			os.Remove(path)
+			expired = true
+			continue
+		}
+
+		if oldestPath == "" || info.ModTime().Before(oldest) {
+			oldestPath = path
+			oldest = info.ModTime()
+		}
+	}
+
+	if !expired && oldestPath != "" {
+		os.Remove(oldestPath)
+	}
+}
+
+func readEntry[V any](path string) (diskEntry[V], error) {
+	var e diskEntry[V]
+
+	f, err := os.Open(path)
+	if err != nil {
+		return e, err
+	}
+	defer f.Close()
+
+	err = gob.NewDecoder(f).Decode(&e)
+	return e, err
+}
@@ -0,0 +1,142 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestDiskCache(t *testing.T, ttl time.Duration, maxEntries int) (*DiskCache[[]byte], *clock) {
+	t.Helper()
+
+	c, err := NewDiskCache[[]byte](t.TempDir(), ttl, maxEntries)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clk := &clock{t: time.Now()}
+	c.now = clk.now
+	return c, clk
+}
+
+func TestDiskCacheReadBack(t *testing.T) {
+	c, clk := newTestDiskCache(t, time.Hour, 10)
+
+	c.Set("alice|blitz|true", []byte("1. e4 e5"))
+
+	// a cache opened on the same directory, as after a restart, reads the entry back
+	reopened, err := NewDiskCache[[]byte](c.dir, time.Hour, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened.now = clk.now
+
+	v, storedAt, ok := reopened.Get("alice|blitz|true")
+	if !ok || string(v) != "1. e4 e5" || !storedAt.Equal(clk.t) {
+		t.Errorf("Get = %q, %v, %v, want the stored PGN", v, storedAt, ok)
+	}
+
+	if _, _, ok := reopened.Get("bob|blitz|true"); ok {
+		t.Error("Get found a key that was never stored")
+	}
+}
+
+func TestDiskCacheExpired(t *testing.T) {
+	c, clk := newTestDiskCache(t, time.Minute, 10)
+
+	c.Set("a", []byte("pgn"))
+
+	clk.t = clk.t.Add(59 * time.Second)
+	if _, _, ok := c.Get("a"); !ok {
+		t.Fatal("Get before the ttl missed the entry")
+	}
+
+	clk.t = clk.t.Add(time.Second)
+	if _, _, ok := c.Get("a"); ok {
+		t.Error("Get after the ttl found the entry")
+	}
+	if _, err := os.Stat(c.path("a")); !os.IsNotExist(err) {
+		t.Errorf("the expired file was kept: %v", err)
+	}
+}
+
+func TestDiskCacheUnreadable(t *testing.T) {
+	tests := []struct {
+		name string
+		// damage rewrites the file of a stored entry
+		damage func(content []byte) []byte
+	}{
+		{"corrupt", func([]byte) []byte { return []byte("not gob at all") }},
+		{"partial", func(content []byte) []byte { return content[:len(content)/2] }},
+		{"empty", func([]byte) []byte { return nil }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := newTestDiskCache(t, time.Hour, 10)
+			c.Set("a", []byte("1. e4 e5 2. Nf3 Nc6 3. Bb5 a6"))
+
+			path := c.path("a")
+			content, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, tt.damage(content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, _, ok := c.Get("a"); ok {
+				t.Error("Get found an entry in a damaged file")
+			}
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Errorf("the damaged file was kept: %v", err)
+			}
+
+			// the key can be stored again
+			c.Set("a", []byte("pgn"))
+			if v, _, ok := c.Get("a"); !ok || string(v) != "pgn" {
+				t.Errorf("Get after storing again = %q, %v", v, ok)
+			}
+		})
+	}
+}
+
+func TestDiskCacheRemovesTemporaryFiles(t *testing.T) {
+	dir := t.TempDir()
+	tmp := filepath.Join(dir, "123.tmp")
+	if err := os.WriteFile(tmp, []byte("half a write"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewDiskCache[[]byte](dir, time.Hour, 10); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+		t.Errorf("the interrupted write was kept: %v", err)
+	}
+}
+
+func TestDiskCacheEvictsOldest(t *testing.T) {
+	c, clk := newTestDiskCache(t, time.Hour, 2)
+
+	for _, key := range []string{"a", "b", "c"} {
+		c.Set(key, []byte(key))
+
+		// files are aged by their modification time
+		clk.t = clk.t.Add(time.Second)
+		if err := os.Chtimes(c.path(key), clk.t, clk.t); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, _, ok := c.Get("a"); ok {
+		t.Error("the oldest entry was kept")
+	}
+	for _, key := range []string{"b", "c"} {
+		if _, _, ok := c.Get(key); !ok {
+			t.Errorf("%s was evicted", key)
+		}
+	}
+}
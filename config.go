@@ -0,0 +1,80 @@
+package main
+
+import (
+	"log"
+	"macg/app/cache"
+	"os"
+	"strconv"
+	"time"
+)
+
+// newGamesCache keeps games on disk in dir so that they survive restarts, or in memory when dir is empty
+// or cannot be created
+func newGamesCache(dir string, ttl time.Duration, maxEntries int) cache.Store[[]byte] {
+	if dir == "" {
+		return cache.NewCache[[]byte](ttl, maxEntries)
+	}
+
+	disk, err := cache.NewDiskCache[[]byte](dir, ttl, maxEntries)
+	if err != nil {
+		log.Printf("Caching games in memory as %s cannot be used: %v", dir, err)
+		return cache.NewCache[[]byte](ttl, maxEntries)
+	}
+
+	return disk
+}
+
+func envString(name string, fallback string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+
+	return fallback
+}
+
+// envDuration reads a duration such as "30s" from the environment
+func envDuration(name string, fallback time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return fallback
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Printf("Ignoring invalid %s=%q: %v", name, v, err)
+		return fallback
+	}
+
+	return d
+}
+
+func envInt(name string, fallback int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return fallback
+	}
+
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		log.Printf("Ignoring invalid %s=%q: %v", name, v, err)
+		return fallback
+	}
+
+	return i
+}
+
+// envBool reads a boolean such as "true" or "1" from the environment
+func envBool(name string, fallback bool) bool {
+	v := os.Getenv(name)
+	if v == "" {
+		return fallback
+	}
+
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Printf("Ignoring invalid %s=%q: %v", name, v, err)
+		return fallback
+	}
+
+	return b
+}
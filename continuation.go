@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"macg/app/acpl"
+	"macg/app/cache"
+	"maps"
+	"strings"
+	"time"
+)
+
+// continuation remembers the games ranked so far by a search so that older ones can be added to them
+// without fetching or ranking those again
+type continuation struct {
+	// key identifies the search, so that a token only continues the search that made it
+	key      string
+	results  []acpl.GameACPL
+	excluded acpl.Exclusions
+	// oldest is when the oldest game gathered so far started
+	oldest time.Time
+	// games counts the games gathered so far, and started is when the first page was fetched
+	games   int
+	started time.Time
+}
+
+// The fetch budget bounds how far back a search can continue, so that prolific users cannot
+// keep the server fetching indefinitely
+var (
+	fetchBudgetGames = envInt("FETCH_BUDGET_GAMES", 10*maxGames)
+	fetchBudgetTime  = envDuration("FETCH_BUDGET_TIME", 10*time.Minute)
+)
+
+// Page is the result of one step of a search through a user's history
+type Page struct {
+	Results []acpl.GameACPL
+	// Token continues the search with older games. It is empty once there are none or the fetch budget is spent.
+	Token string
+	// Partial is set when older games were left out because the fetch budget is spent
+	Partial bool
+	// Excluded are the games left out because their evals look corrupted or could not be parsed
+	Excluded acpl.Exclusions
+	// Games counts the user's games gathered so far, over this page and the earlier ones
+	Games int
+	// StaleSince is when the games were fetched, when Lichess could not be reached and cached games were
+	// ranked instead
+	StaleSince time.Time
+}
+
+var continuations = cache.NewCache[continuation](envDuration("CONTINUATION_TTL", 30*time.Minute), envInt("CONTINUATION_MAX_ENTRIES", 20))
+
+var ErrContinuationExpired = errors.New("this analysis has expired, please start a new search")
+
+// retrievePage ranks the search's games. When s.Continue holds a token, the next page of older games is
+// fetched and ranked together with the earlier pages.
+func (s Search) retrievePage(ctx context.Context) (Page, error) {
+	if s.Paste != "" {
+		results, excluded, err := acpl.RankWithExclusions(ctx, strings.NewReader(s.Paste), s.Username, s.Options)
+		return Page{Results: results, Excluded: excluded}, err
+	}
+
+	if s.Tournament != "" {
+		results, err := s.retrieve(ctx)
+		return Page{Results: results}, err
+	}
+
+	key := gamesCacheKey(s.Username, s.TimeControl, s.RatedOnly, s.Since)
+	searchKey := key + "|" + s.rankingForm()
+
+	var (
+		page       []byte
+		staleSince time.Time
+		err        error
+	)
+
+	previous := continuation{started: time.Now()}
+
+	if s.Continue == "" {
+		page, staleSince, err = cachedPGN(ctx, key, s.Username, func(ctx context.Context) ([]byte, error) {
+			return fetchGames(ctx, s.Username, s.TimeControl, s.RatedOnly, s.Since, time.Time{})
+		})
+	} else {
+		var ok bool
+		previous, _, ok = continuations.Get(s.Continue)
+		if !ok || previous.key != searchKey {
+			return Page{}, ErrContinuationExpired
+		}
+
+		// a token is used once, so that a long walk through a history does not keep every step
+		continuations.Delete(s.Continue)
+
+		var release func()
+		release, err = userFetches.Acquire(ctx, strings.ToLower(s.Username))
+		if err != nil {
+			return Page{}, err
+		}
+
+		page, err = fetchGames(ctx, s.Username, s.TimeControl, s.RatedOnly, s.Since, previous.oldest.Add(-time.Millisecond))
+		release()
+	}
+
+	if err != nil {
+		return Page{}, err
+	}
+
+	results, excluded, err := rankPGN(ctx, page, s.Username, s.Options)
+
+	if err != nil {
+		return Page{}, err
+	}
+
+	if s.Continue != "" {
+		results = acpl.MergeRankings(previous.results, results, s.Options)
+		previous.excluded.Add(excluded)
+		excluded = previous.excluded
+	}
+
+	pageGames := acpl.CountGames(page)
+	games := previous.games + pageGames
+	p := Page{Results: results, Excluded: excluded, Games: games, StaleSince: staleSince}
+
+	// a short page means Lichess has no older games
+	oldest, ok := acpl.OldestGameTime(page)
+	if !ok || pageGames < maxGames {
+		return p, nil
+	}
+
+	if games >= fetchBudgetGames || time.Since(previous.started) >= fetchBudgetTime {
+		p.Partial = true
+		return p, nil
+	}
+
+	p.Token = newContinuationToken()
+	continuations.Set(p.Token, continuation{
+		key:      searchKey,
+		results:  results,
+		excluded: excluded,
+		oldest:   oldest,
+		games:    games,
+		started:  previous.started,
+	})
+
+	return p, nil
+}
+
+// rankingForm encodes the search's form but for its continuation token, so that a token is not used to
+// continue a ranking with other options
+func (s Search) rankingForm() string {
+	form := maps.Clone(s.Form)
+	form.Del("continue")
+	return form.Encode()
+}
+
+func newContinuationToken() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,67 @@
+package cors
+
+import (
+	"net/http"
+	"strings"
+)
+
+type CORS struct {
+	prefix         string
+	allowedOrigins map[string]bool
+	allowAll       bool
+}
+
+// NewCORS only applies to paths starting with prefix. An origin of "*" allows any origin.
+func NewCORS(prefix string, allowedOrigins []string) *CORS {
+	c := &CORS{
+		prefix:         prefix,
+		allowedOrigins: make(map[string]bool),
+	}
+
+	for _, origin := range allowedOrigins {
+		origin = strings.TrimSpace(origin)
+		if origin == "" {
+			continue
+		}
+		if origin == "*" {
+			c.allowAll = true
+		}
+		c.allowedOrigins[origin] = true
+	}
+
+	return c
+}
+
+func (c *CORS) allowed(origin string) bool {
+	return origin != "" && (c.allowAll || c.allowedOrigins[origin])
+}
+
+func (c *CORS) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, c.prefix) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		origin := r.Header.Get("Origin")
+		w.Header().Add("Vary", "Origin")
+
+		if c.allowed(origin) {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+
+		// preflight
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			if c.allowed(origin) {
+				w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+				// Authorization carries the bearer token of the debug endpoints
+				w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, Idempotency-Key")
+				w.Header().Set("Access-Control-Max-Age", "600")
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,109 @@
+package cors
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMiddleware(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := NewCORS("/api/", []string{"https://example.com", " "}).Middleware(next)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		origin string
+		// preflight is the Access-Control-Request-Method header
+		preflight   string
+		status      int
+		allowOrigin string
+		maxAge      string
+	}{
+		{
+			name:        "preflight",
+			method:      http.MethodOptions,
+			path:        "/api/best",
+			origin:      "https://example.com",
+			preflight:   http.MethodPost,
+			status:      http.StatusNoContent,
+			allowOrigin: "https://example.com",
+			maxAge:      "600",
+		},
+		{
+			name:      "preflight from another origin",
+			method:    http.MethodOptions,
+			path:      "/api/best",
+			origin:    "https://evil.example",
+			preflight: http.MethodPost,
+			status:    http.StatusNoContent,
+		},
+		{
+			name:        "request",
+			method:      http.MethodGet,
+			path:        "/api/best",
+			origin:      "https://example.com",
+			status:      http.StatusOK,
+			allowOrigin: "https://example.com",
+		},
+		{
+			name:   "request without origin",
+			method: http.MethodGet,
+			path:   "/api/best",
+			status: http.StatusOK,
+		},
+		{
+			name:   "outside the prefix",
+			method: http.MethodOptions,
+			path:   "/go",
+			origin: "https://example.com",
+			status: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if tt.preflight != "" {
+				r.Header.Set("Access-Control-Request-Method", tt.preflight)
+			}
+
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.allowOrigin {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, tt.allowOrigin)
+			}
+			if got := w.Header().Get("Access-Control-Max-Age"); got != tt.maxAge {
+				t.Errorf("Access-Control-Max-Age = %q, want %q", got, tt.maxAge)
+			}
+		})
+	}
+}
+
+func TestMiddlewareAllowAll(t *testing.T) {
+	handler := NewCORS("/api/", []string{"*"}).Middleware(http.NotFoundHandler())
+
+	r := httptest.NewRequest(http.MethodOptions, "/api/best", nil)
+	r.Header.Set("Origin", "https://anywhere.example")
+	r.Header.Set("Access-Control-Request-Method", http.MethodGet)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "https://anywhere.example" {
+		t.Errorf("Access-Control-Allow-Origin = %q, want the request's origin", got)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Headers"); got != "Authorization, Content-Type, Idempotency-Key" {
+		t.Errorf("Access-Control-Allow-Headers = %q", got)
+	}
+}
@@ -0,0 +1,65 @@
+package fetch_limiter
+
+import (
+	"context"
+	"sync"
+)
+
+// FetchLimiter caps how many fetches may run at once for the same key, such as a username.
+// Further fetches for that key wait for a slot rather than running alongside.
+type FetchLimiter struct {
+	limit int
+
+	mu   sync.Mutex
+	keys map[string]*slots
+}
+
+// slots holds the running fetches for a key; users counts those running and waiting, so that
+// the entry can be dropped once none are left
+type slots struct {
+	running chan struct{}
+	users   int
+}
+
+// NewFetchLimiter allows limit concurrent fetches per key; a limit of 0 or less leaves fetches unlimited
+func NewFetchLimiter(limit int) *FetchLimiter {
+	return &FetchLimiter{limit: limit, keys: make(map[string]*slots)}
+}
+
+// Acquire waits for a slot for key, returning a function that frees it, or the context's error if it
+// is done first
+func (l *FetchLimiter) Acquire(ctx context.Context, key string) (func(), error) {
+	if l.limit <= 0 {
+		return func() {}, nil
+	}
+
+	l.mu.Lock()
+	s, ok := l.keys[key]
+	if !ok {
+		s = &slots{running: make(chan struct{}, l.limit)}
+		l.keys[key] = s
+	}
+	s.users++
+	l.mu.Unlock()
+
+	select {
+	case s.running <- struct{}{}:
+		return func() {
+			<-s.running
+			l.leave(key, s)
+		}, nil
+	case <-ctx.Done():
+		l.leave(key, s)
+		return nil, ctx.Err()
+	}
+}
+
+func (l *FetchLimiter) leave(key string, s *slots) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	s.users--
+	if s.users == 0 {
+		delete(l.keys, key)
+	}
+}
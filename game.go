@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"macg/app/acpl"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/notnil/chess"
+)
+
+var defaultRollingWindow = 5
+
+var gameIdPattern = regexp.MustCompile(`^[a-zA-Z0-9]{8}$`)
+
+type PlayerACPL struct {
+	Username string    `json:"username"`
+	Color    string    `json:"color"`
+	ACPL     float64   `json:"acpl"`
+	Rolling  []float64 `json:"rolling"`
+}
+
+// MoveRow is one move of an annotated game
+type MoveRow struct {
+	Label string `json:"move"`
+	// Eval is in pawns from White's perspective, only set when HasEval
+	Eval    float64 `json:"eval"`
+	HasEval bool    `json:"hasEval"`
+	Loss    float64 `json:"loss"`
+	// Class is "blunder", "mistake", "inaccuracy" or empty
+	Class string `json:"class,omitempty"`
+	// Seconds is how long the move took, only set when HasTime. Quick is set for moves under quickMove.
+	Seconds float64 `json:"seconds"`
+	HasTime bool    `json:"hasTime"`
+	Quick   bool    `json:"quick,omitempty"`
+}
+
+// quickMove is how fast a move must be played to be flagged as quick
+const quickMove = 2 * time.Second
+
+type GameAnalysis struct {
+	GameId  string       `json:"gameId"`
+	URL     string       `json:"url"`
+	White   string       `json:"white"`
+	Black   string       `json:"black"`
+	Result  string       `json:"result"`
+	Opening string       `json:"opening"`
+	Players []PlayerACPL `json:"players"`
+	// Moves are only listed for the best game view
+	Moves   []MoveRow    `json:"moves,omitempty"`
+	Heading string       `json:"-"`
+	Message string       `json:"message,omitempty"`
+	Numbers NumberFormat `json:"-"`
+}
+
+// parseGameId accepts a bare game ID or a Lichess game URL such as https://lichess.org/abcdEFGH/black
+func parseGameId(s string) (string, bool) {
+	s = strings.TrimSpace(s)
+	s = strings.TrimPrefix(s, "https://")
+	s = strings.TrimPrefix(s, "http://")
+	s = strings.TrimPrefix(s, "www.")
+	s = strings.TrimPrefix(s, "lichess.org/")
+
+	if i := strings.IndexAny(s, "/?#"); i >= 0 {
+		s = s[:i]
+	}
+
+	// player-specific URLs append 4 characters to the game ID
+	if len(s) == 12 {
+		s = s[:8]
+	}
+
+	return s, gameIdPattern.MatchString(s)
+}
+
+// gameExportURL is where Lichess exports a single game as PGN with its evals
+func gameExportURL(gameId string) string {
+	return lichessURL + "/game/export/" + gameId + "?tags=true&clocks=true&evals=true&opening=true&literate=false"
+}
+
+func retrieveGame(ctx context.Context, gameId string) (*chess.Game, error) {
+	pgn, err := fetchLichess(ctx, gameExportURL(gameId))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return acpl.ParseGame(bytes.NewReader(pgn))
+}
+
+// analyseGame computes ACPL for username, or for both players when username is empty, as opts says
+func analyseGame(gameId string, g *chess.Game, username string, window int, opts acpl.Options) GameAnalysis {
+	white := acpl.TagValue(g, "White")
+	black := acpl.TagValue(g, "Black")
+
+	analysis := GameAnalysis{
+		GameId:  gameId,
+		URL:     lichessURL + "/" + gameId,
+		White:   white,
+		Black:   black,
+		Result:  acpl.TagValue(g, "Result"),
+		Opening: acpl.TagValue(g, "Opening"),
+		Players: []PlayerACPL{},
+	}
+
+	for _, side := range []struct {
+		name    string
+		color   string
+		isWhite bool
+	}{{white, "white", true}, {black, "black", false}} {
+		if username != "" && !strings.EqualFold(username, side.name) {
+			continue
+		}
+
+		if v, ok := acpl.ComputeSideACPL(g, side.isWhite, opts); ok {
+			analysis.Players = append(analysis.Players, PlayerACPL{
+				Username: side.name,
+				Color:    side.color,
+				ACPL:     v,
+				Rolling:  acpl.RollingACPL(acpl.SideLosses(g, side.isWhite, opts), window),
+			})
+		}
+	}
+
+	return analysis
+}
+
+// annotateMoves lists every move of the game with its eval and, for evaluated moves, how much it lost
+func annotateMoves(g *chess.Game, opts acpl.Options) []MoveRow {
+	losses := make(map[int]float64)
+	for _, isWhite := range []bool{true, false} {
+		for _, l := range acpl.SideLosses(g, isWhite, opts) {
+			losses[l.Ply] = l.Loss
+		}
+	}
+
+	evals := acpl.Evals(g, opts)
+	times := acpl.MoveTimes(g)
+	rows := make([]MoveRow, len(g.Moves()))
+
+	for i := range rows {
+		eval, hasEval := evals[i]
+		spent, hasTime := times[i]
+		rows[i] = MoveRow{
+			Label:   acpl.MoveLabel(g, i),
+			Eval:    eval / 100,
+			HasEval: hasEval,
+			Loss:    losses[i],
+			Class:   acpl.Classify(losses[i]),
+			Seconds: spent.Seconds(),
+			HasTime: hasTime,
+			Quick:   hasTime && spent < quickMove,
+		}
+	}
+
+	return rows
+}
+
+// handleBest shows the user's most accurate game for a search with every move annotated
+func handleBest(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Handling best game for %s", r.RemoteAddr)
+
+	format, ok := negotiateFormat(r, pageFormats)
+	if !ok {
+		notAcceptable(w, pageFormats)
+		return
+	}
+
+	search, ok := parseSearch(w, r)
+	if !ok {
+		return
+	}
+
+	results, err := search.retrieve(r.Context())
+
+	var analysis GameAnalysis
+
+	switch {
+	case err != nil:
+		log.Printf("Error retrieving results for %s: %v", r.RemoteAddr, err)
+		analysis.Message = friendlyError(err, "User not found.")
+	case len(results) == 0:
+		analysis.Message = "No games found. Make sure the username is correct and that games with computer analysis are available."
+	default:
+		g := results[0].Game
+		analysis = analyseGame(acpl.GameKey(g), g, search.Username, defaultRollingWindow, search.Options)
+		analysis.Moves = annotateMoves(g, search.Options)
+
+		// games from other sources link to their own site, if any
+		analysis.URL = acpl.TagValue(g, "Site")
+		if !strings.HasPrefix(analysis.URL, "http") {
+			analysis.URL = ""
+		}
+	}
+
+	analysis.Heading = "The most accurate game of " + search.Username
+	analysis.Numbers = numberFormatFor(r)
+
+	setCacheHeaders(w)
+
+	if format == formatJSON {
+		writeJSON(w, analysis)
+		return
+	}
+
+	if err := renderTemplate(w, "game.html", analysis); err != nil {
+		log.Printf("Error rendering game template: %v", err)
+	}
+}
+
+func handleGame(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Handling game for %s", r.RemoteAddr)
+
+	format, ok := negotiateFormat(r, pageFormats)
+	if r.URL.Query().Get("format") == formatJSON {
+		format, ok = formatJSON, true
+	}
+	if !ok {
+		notAcceptable(w, pageFormats)
+		return
+	}
+
+	gameId, ok := parseGameId(r.FormValue("id"))
+	if !ok {
+		http.Error(w, "Invalid game ID", http.StatusBadRequest)
+		return
+	}
+
+	username := strings.TrimSpace(r.FormValue("username"))
+
+	g, _, ok := parsedGames.Get(gameId)
+
+	if !ok {
+		var err error
+		g, err = retrieveGame(r.Context(), gameId)
+		if err != nil {
+			log.Printf("Error retrieving game %s for %s: %v", gameId, r.RemoteAddr, err)
+			http.Error(w, friendlyError(err, "Game not found."), errorStatus(err))
+			return
+		}
+
+		parsedGames.Set(gameId, g)
+	}
+
+	window, err := strconv.Atoi(r.FormValue("window"))
+	if err != nil || window < 1 {
+		window = defaultRollingWindow
+	}
+
+	analysis := analyseGame(gameId, g, username, window, acpl.Options{})
+	analysis.Numbers = numberFormatFor(r)
+
+	setCacheHeaders(w)
+
+	if format == formatJSON {
+		writeJSON(w, analysis)
+		return
+	}
+
+	if err := renderTemplate(w, "game.html", analysis); err != nil {
+		log.Printf("Error rendering game template: %v", err)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// singleGamePGN is a short analysed game in which alice loses 25 centipawns a move and bob 50
+const singleGamePGN = `[Event "Rated blitz game"]
+[Site "https://lichess.org/abcdEFGH"]
+[White "alice"]
+[Black "bob"]
+[Result "*"]
+[Opening "King's Knight Opening"]
+
+1. e4 { [%eval 0.5] } 1... e5 { [%eval 0.25] } 2. Nf3 { [%eval 0] } 2... Nc6 { [%eval 1] } *
+`
+
+func TestHandleGame(t *testing.T) {
+	stubLichess(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/game/export/abcdEFGH" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(singleGamePGN))
+	})
+
+	tests := []struct {
+		name   string
+		target string
+		want   []PlayerACPL
+	}{
+		{
+			name:   "both players",
+			target: "/game?format=json&id=abcdEFGH",
+			want:   []PlayerACPL{{Username: "alice", Color: "white", ACPL: 25}, {Username: "bob", Color: "black", ACPL: 50}},
+		},
+		{
+			name:   "one player",
+			target: "/game?format=json&id=https://lichess.org/abcdEFGH/black&username=Bob",
+			want:   []PlayerACPL{{Username: "bob", Color: "black", ACPL: 50}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			handleGame(w, httptest.NewRequest(http.MethodGet, tt.target, nil))
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+			}
+
+			var analysis GameAnalysis
+			if err := json.Unmarshal(w.Body.Bytes(), &analysis); err != nil {
+				t.Fatal(err)
+			}
+
+			if analysis.GameId != "abcdEFGH" || analysis.Opening != "King's Knight Opening" {
+				t.Errorf("analysis = %+v, want game abcdEFGH", analysis)
+			}
+			var players []PlayerACPL
+			for _, p := range analysis.Players {
+				players = append(players, PlayerACPL{Username: p.Username, Color: p.Color, ACPL: p.ACPL})
+			}
+
+			if !reflect.DeepEqual(players, tt.want) {
+				t.Errorf("players = %+v, want %+v", players, tt.want)
+			}
+		})
+	}
+}
+
+func TestHandleGameErrors(t *testing.T) {
+	stubLichess(t, http.NotFound)
+
+	for target, want := range map[string]int{
+		"/game?id=abc":      http.StatusBadRequest,
+		"/game?id=abcdEFGH": http.StatusNotFound,
+	} {
+		w := httptest.NewRecorder()
+		handleGame(w, httptest.NewRequest(http.MethodGet, target, nil))
+
+		if w.Code != want {
+			t.Errorf("%s: status = %d, want %d", target, w.Code, want)
+		}
+	}
+}
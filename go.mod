@@ -2,4 +2,4 @@ module macg/app
 
 go 1.25.2
 
-require github.com/notnil/chess v1.10.0 // indirect
+require github.com/notnil/chess v1.10.0
@@ -0,0 +1,49 @@
+package health
+
+import "sync"
+
+// Window keeps the outcomes of the most recent calls to an upstream service
+type Window struct {
+	mu       sync.Mutex
+	outcomes []bool
+	next     int
+	count    int
+}
+
+// NewWindow keeps the last size outcomes, at least one
+func NewWindow(size int) *Window {
+	return &Window{
+		outcomes: make([]bool, max(1, size)),
+	}
+}
+
+func (w *Window) Record(success bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.outcomes[w.next] = success
+	w.next = (w.next + 1) % len(w.outcomes)
+	if w.count < len(w.outcomes) {
+		w.count++
+	}
+}
+
+// SuccessRatio returns the share of recorded calls that succeeded and how many calls were recorded.
+// With no calls recorded, the ratio is 1.
+func (w *Window) SuccessRatio() (float64, int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.count == 0 {
+		return 1, 0
+	}
+
+	successes := 0
+	for i := 0; i < w.count; i++ {
+		if w.outcomes[i] {
+			successes++
+		}
+	}
+
+	return float64(successes) / float64(w.count), w.count
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// historyEventTimeout is how long a history search can go without sending an event, as a page of games is
+// fetched and ranked, before its connection is closed
+var historyEventTimeout = envDuration("HISTORY_EVENT_TIMEOUT", 2*time.Minute)
+
+// HistoryProgress is how far a full-history search has got. Estimate is the number of games the user has
+// played in the searched time controls, capped by the fetch budget. Only analysed games are fetched, so
+// Fetched usually ends below it.
+type HistoryProgress struct {
+	Fetched  int `json:"fetched"`
+	Estimate int `json:"estimate"`
+}
+
+// HistoryResults ends a full-history search
+type HistoryResults struct {
+	Fetched int       `json:"fetched"`
+	Partial bool      `json:"partial"`
+	Results []GameRow `json:"results"`
+}
+
+// retrieveHistory ranks the search's games page by page until Lichess has no older ones or the fetch
+// budget is spent, calling progress with the number of games gathered after each page
+func (s Search) retrieveHistory(ctx context.Context, progress func(fetched int)) (Page, error) {
+	for {
+		page, err := s.retrievePage(ctx)
+
+		if err != nil {
+			return Page{}, err
+		}
+
+		progress(page.Games)
+
+		if page.Token == "" {
+			return page, nil
+		}
+
+		s.Continue = page.Token
+	}
+}
+
+// estimateGames guesses how many games a full-history search will fetch from the user's profile, falling
+// back on the fetch budget when the profile cannot be read
+func estimateGames(ctx context.Context, s Search) int {
+	counts, err := cachedTimeControls(ctx, s.Username)
+
+	if err != nil {
+		log.Printf("Error estimating games for %s: %v", s.Username, err)
+		return fetchBudgetGames
+	}
+
+	searched := strings.Split(s.TimeControl, ",")
+
+	games := 0
+	for _, c := range counts {
+		if s.TimeControl == "all" || slices.Contains(searched, c.TimeControl) {
+			games += c.Games
+		}
+	}
+
+	return min(games, fetchBudgetGames)
+}
+
+// handleHistory searches through the user's whole history, streaming Server-Sent Events: a progress event
+// after each page of games, then a results event with the ranking or an error event
+func handleHistory(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Handling history for %s", r.RemoteAddr)
+
+	search, ok := parseSearch(w, r)
+	if !ok {
+		return
+	}
+
+	ctx := r.Context()
+	rc := http.NewResponseController(w)
+
+	// the search can outlast the server's WriteTimeout, so each event gets its own deadline
+	extendDeadline := func() {
+		if err := rc.SetWriteDeadline(time.Now().Add(historyEventTimeout)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			log.Printf("Error extending the write deadline for %s: %v", r.RemoteAddr, err)
+		}
+	}
+
+	extendDeadline()
+	setCacheHeaders(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.WriteHeader(http.StatusOK)
+
+	if err := rc.Flush(); err != nil {
+		log.Printf("Error streaming history to %s: %v", r.RemoteAddr, err)
+		return
+	}
+
+	send := func(event string, v any) {
+		data, err := json.Marshal(v)
+		if err != nil {
+			log.Printf("Error encoding %s event: %v", event, err)
+			return
+		}
+
+		extendDeadline()
+		fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+		rc.Flush()
+	}
+
+	estimate := estimateGames(ctx, search)
+
+	page, err := search.retrieveHistory(ctx, func(fetched int) {
+		send("progress", HistoryProgress{Fetched: fetched, Estimate: max(estimate, fetched)})
+	})
+
+	if ctx.Err() != nil {
+		log.Printf("Client %s went away during its history search", r.RemoteAddr)
+		return
+	}
+
+	if err != nil {
+		log.Printf("Error retrieving history for %s: %v", r.RemoteAddr, err)
+		send("error", struct {
+			Error string `json:"error"`
+		}{friendlyError(err, "User not found.")})
+		return
+	}
+
+	send("results", HistoryResults{
+		Fetched: page.Games,
+		Partial: page.Partial,
+		Results: slices.Collect(rowSeq(page.Results, maxResults, search.Ties)),
+	})
+}
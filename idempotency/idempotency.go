@@ -0,0 +1,162 @@
+package idempotency
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"macg/app/cache"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// maxBodyBytes bounds the request bodies read to tell requests reusing a key apart; requests with larger
+// bodies are passed through without being replayed
+const maxBodyBytes = 1 << 20
+
+// response is what a handler wrote, kept to be replayed
+type response struct {
+	// request is a hash of the query and body of the request answered, see fingerprint
+	request [sha256.Size]byte
+	status  int
+	header  http.Header
+	body    []byte
+}
+
+type Idempotency struct {
+	prefix    string
+	responses *cache.Cache[response]
+}
+
+// NewIdempotency only applies to paths starting with prefix. Responses are replayed for ttl after
+// they were first sent, and at most maxEntries are kept.
+func NewIdempotency(prefix string, ttl time.Duration, maxEntries int) *Idempotency {
+	return &Idempotency{
+		prefix:    prefix,
+		responses: cache.NewCache[response](ttl, maxEntries),
+	}
+}
+
+// recorder passes a response through while keeping a copy of it, unless the response is streamed
+type recorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+	// streamed is set once the handler flushes, as streams are not kept
+	streamed bool
+}
+
+func (rec *recorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+func (rec *recorder) Flush() {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.streamed = true
+	rec.body.Reset()
+	http.NewResponseController(rec.ResponseWriter).Flush()
+}
+
+func (rec *recorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *recorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	if !rec.streamed {
+		rec.body.Write(b)
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+// fingerprint hashes the query and body of r, restoring its body for the handler. It returns false when
+// the body is too large to hash.
+func fingerprint(r *http.Request) ([sha256.Size]byte, bool) {
+	var body []byte
+
+	if r.Body != nil {
+		var err error
+		body, err = io.ReadAll(io.LimitReader(r.Body, maxBodyBytes+1))
+
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+
+		if err != nil || len(body) > maxBodyBytes {
+			return [sha256.Size]byte{}, false
+		}
+	}
+
+	return sha256.Sum256(append([]byte(r.URL.RawQuery+"\n"), body...)), true
+}
+
+// Middleware replays the earlier response to a request with the same Idempotency-Key header, method
+// and path, so that clients retrying a request do not trigger another fetch. A key reused with another
+// query or body is answered with 422 Unprocessable Entity. Server errors are not kept so that they can
+// be retried, and neither are streamed responses.
+func (i *Idempotency) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+
+		if key == "" || !strings.HasPrefix(r.URL.Path, i.prefix) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key = r.Method + " " + r.URL.Path + " " + key
+
+		request, ok := fingerprint(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if prior, _, ok := i.responses.Get(key); ok {
+			if prior.request != request {
+				http.Error(w, "Idempotency-Key was already used for another request", http.StatusUnprocessableEntity)
+				return
+			}
+
+			for name, values := range prior.header {
+				w.Header()[name] = values
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(prior.status)
+			w.Write(prior.body)
+			return
+		}
+
+		// headers set by outer middleware, such as CORS, depend on the request and are not replayed
+		outer := w.Header().Clone()
+
+		rec := &recorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		if rec.status == 0 || rec.status >= 500 || rec.streamed {
+			return
+		}
+
+		header := http.Header{}
+		for name, values := range w.Header() {
+			if !slices.Equal(values, outer[name]) {
+				header[name] = slices.Clone(values)
+			}
+		}
+
+		i.responses.Set(key, response{
+			request: request,
+			status:  rec.status,
+			header:  header,
+			body:    rec.body.Bytes(),
+		})
+	})
+}
@@ -0,0 +1,165 @@
+package idempotency
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// counter answers with how many times it was called, failing with ?status= and flushing with ?stream=1
+type counter struct {
+	calls int
+}
+
+func (c *counter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.calls++
+	body, _ := io.ReadAll(r.Body)
+
+	w.Header().Set("Content-Type", "text/plain")
+	if status, err := strconv.Atoi(r.URL.Query().Get("status")); err == nil {
+		w.WriteHeader(status)
+	}
+
+	io.WriteString(w, strconv.Itoa(c.calls)+" "+string(body))
+
+	if r.URL.Query().Get("stream") != "" {
+		w.(http.Flusher).Flush()
+	}
+}
+
+// send makes a request with an Idempotency-Key, through a CORS-like outer middleware setting Vary
+func send(handler http.Handler, method string, target string, key string, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	if key != "" {
+		r.Header.Set("Idempotency-Key", key)
+	}
+
+	w := httptest.NewRecorder()
+	w.Header().Set("Vary", "Origin")
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestMiddleware(t *testing.T) {
+	type request struct {
+		method string
+		target string
+		key    string
+		body   string
+	}
+
+	first := request{http.MethodPost, "/api/best?username=alice", "abc", "time_control=blitz"}
+
+	tests := []struct {
+		name   string
+		then   request
+		status int
+		body   string
+		replay bool
+	}{
+		{
+			name:   "replayed",
+			then:   first,
+			status: http.StatusOK,
+			body:   "1 time_control=blitz",
+			replay: true,
+		},
+		{
+			name:   "another key",
+			then:   request{http.MethodPost, "/api/best?username=alice", "def", "time_control=blitz"},
+			status: http.StatusOK,
+			body:   "2 time_control=blitz",
+		},
+		{
+			name:   "without key",
+			then:   request{http.MethodPost, "/api/best?username=alice", "", "time_control=blitz"},
+			status: http.StatusOK,
+			body:   "2 time_control=blitz",
+		},
+		{
+			name:   "another path",
+			then:   request{http.MethodPost, "/api/trend?username=alice", "abc", "time_control=blitz"},
+			status: http.StatusOK,
+			body:   "2 time_control=blitz",
+		},
+		{
+			name:   "another body",
+			then:   request{http.MethodPost, "/api/best?username=alice", "abc", "time_control=rapid"},
+			status: http.StatusUnprocessableEntity,
+			body:   "Idempotency-Key was already used for another request\n",
+		},
+		{
+			name:   "another query",
+			then:   request{http.MethodPost, "/api/best?username=bob", "abc", "time_control=blitz"},
+			status: http.StatusUnprocessableEntity,
+			body:   "Idempotency-Key was already used for another request\n",
+		},
+		{
+			name:   "outside the prefix",
+			then:   request{http.MethodPost, "/go?username=alice", "abc", "time_control=blitz"},
+			status: http.StatusOK,
+			body:   "2 time_control=blitz",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := &counter{}
+			handler := NewIdempotency("/api/", time.Minute, 10).Middleware(next)
+
+			send(handler, first.method, first.target, first.key, first.body)
+			w := send(handler, tt.then.method, tt.then.target, tt.then.key, tt.then.body)
+
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+			if w.Body.String() != tt.body {
+				t.Errorf("body = %q, want %q", w.Body, tt.body)
+			}
+			if replayed := w.Header().Get("Idempotent-Replayed") == "true"; replayed != tt.replay {
+				t.Errorf("replayed = %v, want %v", replayed, tt.replay)
+			}
+			// the outer Vary is not replayed on top of the one already set
+			if vary := w.Header().Values("Vary"); len(vary) != 1 {
+				t.Errorf("Vary = %v, want only the outer one", vary)
+			}
+		})
+	}
+}
+
+func TestMiddlewareNotKept(t *testing.T) {
+	for _, target := range []string{
+		"/api/best?status=502",
+		"/api/best?stream=1",
+	} {
+		next := &counter{}
+		handler := NewIdempotency("/api/", time.Minute, 10).Middleware(next)
+
+		send(handler, http.MethodPost, target, "abc", "")
+		w := send(handler, http.MethodPost, target, "abc", "")
+
+		if next.calls != 2 || w.Header().Get("Idempotent-Replayed") != "" {
+			t.Errorf("%s: the response was replayed, want it answered again", target)
+		}
+	}
+}
+
+func TestMiddlewareLargeBody(t *testing.T) {
+	next := &counter{}
+	handler := NewIdempotency("/api/", time.Minute, 10).Middleware(next)
+	body := strings.Repeat("a", maxBodyBytes+1)
+
+	send(handler, http.MethodPost, "/api/best", "abc", body)
+	w := send(handler, http.MethodPost, "/api/best", "abc", body)
+
+	if next.calls != 2 {
+		t.Errorf("calls = %d, want the large request passed through twice", next.calls)
+	}
+	if w.Body.Len() != len("2 ")+len(body) {
+		t.Errorf("body has %d bytes, want the whole request body passed on", w.Body.Len())
+	}
+}
@@ -1,36 +1,133 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"html/template"
+	"io"
+	"iter"
 	"log"
 	"macg/app/acpl"
+	"macg/app/cache"
+	"macg/app/cors"
+	"macg/app/fetch_limiter"
+	"macg/app/health"
+	"macg/app/idempotency"
 	"macg/app/rate_limiter"
+	"macg/app/recent_searches"
+	"macg/app/single_flight"
+	"macg/app/slow_requests"
+	"macg/app/stats"
+	"maps"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"slices"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
+
+	"github.com/notnil/chess"
 )
 
-var templates = template.Must(template.ParseFiles("index.html", "results.html", "footer.html"))
+var templateFiles = []string{"index.html", "results.html", "results-print.html", "results-table.html", "game.html", "footer.html"}
+var templates = template.Must(template.ParseFiles(templateFiles...))
+
+// reloadTemplates re-parses the templates for every page so that edits show without a restart
+var reloadTemplates = envBool("RELOAD_TEMPLATES", false)
+var lichessURL = "https://lichess.org"
 var maxGames = 1000
 var maxResults = 50
 
+// maxCSVResults caps CSV downloads, which stream rows instead of rendering a page
+var maxCSVResults = envInt("CSV_MAX_RESULTS", maxGames)
+
+// openingFallback is "eco" (ECO code, else "Unknown opening"), "unknown" or "none" for games without an Opening tag
+var openingFallback = envString("OPENING_FALLBACK", "eco")
+
+// lichessUserAgent identifies this app to Lichess; lichessToken, when set, is sent as an OAuth bearer token
+var lichessUserAgent = envString("LICHESS_USER_AGENT", "most-accurate-games")
+var lichessToken = os.Getenv("LICHESS_TOKEN")
+
+var fetchCooldown = envDuration("FETCH_COOLDOWN", 30*time.Second)
+
+// userFetches limits how many Lichess fetches run at once for the same username, so that a burst of
+// searches for one user waits for the first fetch and then finds its games cached
+var userFetches = fetch_limiter.NewFetchLimiter(envInt("MAX_USER_FETCHES", 1))
+
+var recentSearches = recent_searches.NewRecentSearches(envInt("RECENT_SEARCHES", 100))
+
+// gamesCache holds the raw PGN fetched per username, time control and rated filter
+var gamesCache = newGamesCache(os.Getenv("CACHE_DIR"), envDuration("CACHE_TTL", 10*time.Minute), envInt("CACHE_MAX_ENTRIES", 50))
+
+// staleGames keeps the games last fetched for each search for longer than gamesCache, to fall back on
+// while Lichess is down
+var staleGames = cache.NewCache[[]byte](envDuration("STALE_CACHE_TTL", 24*time.Hour), envInt("STALE_CACHE_MAX_ENTRIES", 50))
+
+// parsedGames holds ranked games by GameId so single-game views do not fetch them again
+var parsedGames = cache.NewCache[*chess.Game](envDuration("GAME_CACHE_TTL", time.Hour), envInt("GAME_CACHE_MAX_ENTRIES", 500))
+
+// lichessHealth tracks recent Lichess fetch outcomes for /readyz
+var lichessHealth = health.NewWindow(envInt("HEALTH_WINDOW", 50))
+
+// minPointsLost is how many expected points the user must have given up for it to be pointed out
+const minPointsLost = 0.5
+
+// accurateDrawACPL is the most either player may average for a draw to be listed as accurate
+const accurateDrawACPL = 20.0
+
+// minSampleGames is how many games a group of games, such as a time control, a colour or an hour of the
+// day, needs for its average to be reported
+var minSampleGames = envInt("MIN_SAMPLE_GAMES", 5)
+
+// minColorGap is how large a difference in ACPL it takes to point out that the user plays one colour better
+var minColorGap = 10.0
+
+// degradedRatio is the success ratio below which Lichess is reported as degraded
+var degradedRatio = 0.8
+
+// fetchCooldowns records when the games under each cache key were last fetched from Lichess for a search
+var fetchCooldowns = cache.NewCache[struct{}](fetchCooldown, 10000)
+
 type GameRow struct {
-	GameId        string
-	Rank          int
-	ACPL          float64
-	FormattedDate string
-	White         string
-	WhiteElo      string
-	Black         string
-	BlackElo      string
-	ResultWhite   string
-	ResultBlack   string
-	Result        string
-	Opening       string
-	Moves         int
-	URL           string
+	GameId          string  `json:"gameId"`
+	Rank            int     `json:"rank"`
+	ACPL            float64 `json:"acpl"`
+	Score           float64 `json:"score"`
+	WorstLoss       float64 `json:"worstLoss"`
+	WorstMove       string  `json:"worstMove"`
+	Blunders        int     `json:"blunders"`
+	OpponentACPL    float64 `json:"opponentAcpl"`
+	HasOpponentACPL bool    `json:"hasOpponentAcpl"`
+	// RatingChange is the rating points the player gained or lost, only set when HasRatingChange
+	RatingChange    int  `json:"ratingChange"`
+	HasRatingChange bool `json:"hasRatingChange"`
+	// SavedFrom describes the worst eval of games the player won from a lost position, e.g. "-5.2 after 23... Kf8"
+	SavedFrom string `json:"savedFrom,omitempty"`
+	// Suspect is why the game's evals look corrupted, see acpl.Suspect
+	Suspect string `json:"suspect,omitempty"`
+	// TurningPoint describes the move that decided the game and the player's ACPL around it,
+	// e.g. "23... Kf8 (12 ACPL before, 45 after)"
+	TurningPoint string `json:"turningPoint,omitempty"`
+	// TheoryPlies is how many plies the game followed opening theory, and LeftTheory the move that left
+	// it, e.g. "6. Bc4", unless the game ended in theory. Both are only set when the search asks for them.
+	TheoryPlies   int    `json:"theoryPlies,omitempty"`
+	LeftTheory    string `json:"leftTheory,omitempty"`
+	FormattedDate string `json:"date"`
+	White         string `json:"white"`
+	WhiteElo      string `json:"whiteElo"`
+	Black         string `json:"black"`
+	BlackElo      string `json:"blackElo"`
+	ResultWhite   string `json:"-"`
+	ResultBlack   string `json:"-"`
+	Result        string `json:"result"`
+	Opening       string `json:"opening"`
+	Moves         int    `json:"moves"`
+	URL           string `json:"url"`
 }
 
 type HTTPStatusError struct {
@@ -42,26 +139,153 @@ func (e *HTTPStatusError) Error() string {
 	return fmt.Sprintf("unexpected HTTP status %d (%s)", e.StatusCode, e.Status)
 }
 
+// CooldownError is returned when the same games of a username were fetched too recently to fetch them again
+type CooldownError struct {
+	Username  string
+	Remaining time.Duration
+}
+
+func (e *CooldownError) Error() string {
+	return fmt.Sprintf("games for %s were fetched moments ago, please try again in %.0f seconds", e.Username, e.Remaining.Seconds())
+}
+
+// friendlyError explains a retrieval failure without exposing upstream details, which are logged instead.
+// notFound is shown when Lichess answers 404.
+func friendlyError(err error, notFound string) string {
+	var statusErr *HTTPStatusError
+	if errors.As(err, &statusErr) {
+		switch {
+		case statusErr.StatusCode == http.StatusNotFound:
+			return notFound
+		case statusErr.StatusCode == http.StatusTooManyRequests:
+			return "Too many requests, try again shortly."
+		case statusErr.StatusCode >= 500:
+			return "Lichess is having trouble, try again later."
+		}
+	}
+
+	var cooldownErr *CooldownError
+	if errors.As(err, &cooldownErr) || errors.Is(err, ErrContinuationExpired) {
+		return "Failed to retrieve games: " + err.Error() + "."
+	}
+
+	return "Failed to retrieve games."
+}
+
+// errorStatus is the status to answer a retrieval failure with: what Lichess answered for missing
+// users and games and for rate limits, and 502 for its server errors and unreachable hosts
+func errorStatus(err error) int {
+	var statusErr *HTTPStatusError
+	if errors.As(err, &statusErr) {
+		switch statusErr.StatusCode {
+		case http.StatusNotFound, http.StatusTooManyRequests:
+			return statusErr.StatusCode
+		}
+	}
+
+	var cooldownErr *CooldownError
+	if errors.As(err, &cooldownErr) {
+		return http.StatusTooManyRequests
+	}
+
+	if errors.Is(err, ErrContinuationExpired) {
+		return http.StatusGone
+	}
+
+	return http.StatusBadGateway
+}
+
+// renderTemplate executes the named template. When reloadTemplates is set, the files are parsed again
+// first, and a template that no longer parses is reported as a server error instead of crashing.
+// The reloaded copy is only used for this request; templates is never written after startup, so
+// concurrent requests need no locking.
+func renderTemplate(w http.ResponseWriter, name string, data any) error {
+	t := templates
+
+	if reloadTemplates {
+		var err error
+		t, err = template.ParseFiles(templateFiles...)
+
+		if err != nil {
+			http.Error(w, "Template error: "+err.Error(), http.StatusInternalServerError)
+			return err
+		}
+	}
+
+	return t.ExecuteTemplate(w, name, data)
+}
+
 func setCacheHeaders(w http.ResponseWriter) {
 	w.Header().Set("Cache-Control", "no-store, no-cache, must-revalidate")
 	w.Header().Set("Pragma", "no-cache")
 }
 
-func retrieveResults(username string, timeControl string, ratedOnly bool, minPlies int) ([]acpl.GameACPL, error) {
-	url := "https://lichess.org/api/games/user/" + username + "?analysed=true&tags=true&clocks=false&evals=true&opening=true&literate=false&max=" + strconv.Itoa(maxGames) + "&perfType=" + timeControl
+// fetchGames downloads the user's analysed games as PGN, newest first, optionally only those played from since
+// and before until
+func fetchGames(ctx context.Context, username string, timeControl string, ratedOnly bool, since time.Time, until time.Time) ([]byte, error) {
+	url := lichessURL + "/api/games/user/" + username + "?analysed=true&tags=true&clocks=true&evals=true&opening=true&literate=false&max=" + strconv.Itoa(maxGames)
+
+	if timeControl != "all" {
+		url += "&perfType=" + timeControl
+	}
 
 	if ratedOnly {
 		url += "&rated=true"
 	}
 
-	resp, err := http.Get(url)
+	if !since.IsZero() {
+		url += "&since=" + strconv.FormatInt(since.UnixMilli(), 10)
+	}
+
+	if !until.IsZero() {
+		url += "&until=" + strconv.FormatInt(until.UnixMilli(), 10)
+	}
+
+	if lichessExportFormat == exportNDJSON {
+		return fetchGamesNDJSON(ctx, url+"&pgnInJson=true")
+	}
+
+	return fetchLichess(ctx, url)
+}
+
+// fetchLichess downloads a response body, such as a PGN export, from Lichess
+func fetchLichess(ctx context.Context, url string) ([]byte, error) {
+	return fetchLichessAs(ctx, url, "")
+}
+
+// fetchLichessAs is fetchLichess asking for the media type accept, when set, such as application/x-ndjson
+func fetchLichessAs(ctx context.Context, url string, accept string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("User-Agent", lichessUserAgent)
+
+	if accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+
+	if lichessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+lichessToken)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
 
 	if err != nil {
+		// a client going away says nothing about Lichess
+		if ctx.Err() == nil {
+			lichessHealth.Record(false)
+		}
 		return nil, err
 	}
 
 	defer resp.Body.Close()
 
+	// a missing user is Lichess working as intended
+	lichessHealth.Record(resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests)
+
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 		return nil, &HTTPStatusError{
 			StatusCode: resp.StatusCode,
@@ -69,20 +293,340 @@ func retrieveResults(username string, timeControl string, ratedOnly bool, minPli
 		}
 	}
 
-	results, err := acpl.RankByACPL(resp.Body, username, minPlies)
+	return io.ReadAll(resp.Body)
+}
+
+func gamesCacheKey(username string, timeControl string, ratedOnly bool, since time.Time) string {
+	key := strings.ToLower(username) + "|" + timeControl + "|" + strconv.FormatBool(ratedOnly)
+
+	if !since.IsZero() {
+		key += "|" + strconv.FormatInt(since.UnixMilli(), 10)
+	}
+
+	return key
+}
+
+func retrieveResults(ctx context.Context, username string, timeControl string, ratedOnly bool, since time.Time, opts acpl.Options) ([]acpl.GameACPL, error) {
+	key := gamesCacheKey(username, timeControl, ratedOnly, since)
+
+	return rankCached(ctx, key, username, opts, func(ctx context.Context) ([]byte, error) {
+		return fetchGames(ctx, username, timeControl, ratedOnly, since, time.Time{})
+	})
+}
+
+// rankCached ranks the games cached under key, fetching them first unless username is cooling down
+func rankCached(ctx context.Context, key string, username string, opts acpl.Options, fetch func(ctx context.Context) ([]byte, error)) ([]acpl.GameACPL, error) {
+	pgn, _, err := cachedPGN(ctx, key, username, fetch)
 
 	if err != nil {
 		return nil, err
 	}
 
-	return results, nil
+	results, _, err := rankPGN(ctx, pgn, username, opts)
+	return results, err
+}
+
+// fetchedGames is what a fetch shared through gamesFetches found
+type fetchedGames struct {
+	pgn        []byte
+	staleSince time.Time
+}
+
+// gamesFetches shares a fetch between the searches for the same uncached games that arrive while it runs
+var gamesFetches = single_flight.NewGroup[fetchedGames]()
+
+// cachedPGN returns the games cached under key, fetching them first unless key is cooling down.
+// Concurrent searches for the same key share one fetch, which is canceled once they have all gone away.
+// Fetches wait for one of the user's slots in userFetches. When Lichess cannot be reached, the last
+// games fetched under key are returned instead, with when they were fetched as staleSince.
+func cachedPGN(ctx context.Context, key string, username string, fetch func(ctx context.Context) ([]byte, error)) (pgn []byte, staleSince time.Time, err error) {
+	if pgn, _, ok := gamesCache.Get(key); ok {
+		return pgn, time.Time{}, nil
+	}
+
+	games, err := gamesFetches.Do(ctx, key, func(ctx context.Context) (fetchedGames, error) {
+		pgn, staleSince, err := fetchPGN(ctx, key, username, fetch)
+		return fetchedGames{pgn: pgn, staleSince: staleSince}, err
+	})
+
+	return games.pgn, games.staleSince, err
+}
+
+// fetchPGN fetches the games for cachedPGN, once one of the user's slots is free
+func fetchPGN(ctx context.Context, key string, username string, fetch func(ctx context.Context) ([]byte, error)) (pgn []byte, staleSince time.Time, err error) {
+	userKey := strings.ToLower(username)
+
+	release, err := userFetches.Acquire(ctx, userKey)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer release()
+
+	// the fetch we waited for may have cached these games
+	if pgn, _, ok := gamesCache.Get(key); ok {
+		return pgn, time.Time{}, nil
+	}
+
+	if _, lastFetch, ok := fetchCooldowns.Get(key); ok {
+		return nil, time.Time{}, &CooldownError{
+			Username:  username,
+			Remaining: fetchCooldown - time.Since(lastFetch),
+		}
+	}
+
+	pgn, err = fetch(ctx)
+
+	if err != nil {
+		if stale, storedAt, ok := staleGames.Get(key); ok && ctx.Err() == nil && lichessDown(err) {
+			log.Printf("Serving games cached at %s for %s: %v", storedAt.Format(time.RFC3339), username, err)
+			return stale, storedAt, nil
+		}
+		return nil, time.Time{}, err
+	}
+
+	storeGames(key, pgn)
+	fetchCooldowns.Set(key, struct{}{})
+
+	return pgn, time.Time{}, nil
+}
+
+// storeGames caches the games just fetched under key, also as the fallback for when Lichess is down. It
+// leaves the cooldown to fetchPGN, so that a background refresh does not hold back a user's search.
+func storeGames(key string, pgn []byte) {
+	gamesCache.Set(key, pgn)
+	staleGames.Set(key, pgn)
+}
+
+// lichessDown reports whether err means Lichess could not be reached or failed, as opposed to answering
+// that the request was wrong, e.g. for a missing user
+func lichessDown(err error) bool {
+	var statusErr *HTTPStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500
+	}
+	return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
+
+// rankPGN ranks the games in pgn, also counting those left out for a reason worth reporting
+func rankPGN(ctx context.Context, pgn []byte, username string, opts acpl.Options) ([]acpl.GameACPL, acpl.Exclusions, error) {
+	results, excluded, err := acpl.RankWithExclusions(ctx, bytes.NewReader(pgn), username, opts)
+
+	if err != nil {
+		return nil, acpl.Exclusions{}, err
+	}
+
+	slow_requests.Note(ctx, username, len(results))
+
+	// only the games shown are linked to /game, and caching them all would evict other searches' games
+	for _, r := range results[:min(len(results), maxResults)] {
+		parsedGames.Set(acpl.GameKey(r.Game), r.Game)
+	}
+
+	return results, excluded, nil
+}
+
+// tagUnescaper undoes the escaping of quotes and backslashes in PGN tag values
+var tagUnescaper = strings.NewReplacer(`\\`, `\`, `\"`, `"`)
+
+// openingName shortens the Opening tag to its family, e.g. "Sicilian Defense" for "Sicilian Defense, Najdorf Variation".
+// Games without an Opening tag fall back according to openingFallback.
+func openingName(g *chess.Game) string {
+	// SplitN always returns at least one element, even for an empty tag
+	if opening := strings.SplitN(acpl.TagValue(g, "Opening"), ",", 2)[0]; opening != "" && opening != "?" {
+		return opening
+	}
+
+	switch openingFallback {
+	case "none":
+		return ""
+	case "eco":
+		if eco := acpl.TagValue(g, "ECO"); eco != "" && eco != "?" {
+			return "ECO " + eco
+		}
+	}
+
+	return "Unknown opening"
+}
+
+// textTag reads a free-text tag such as a player name. PGN files are not always valid UTF-8,
+// and invalid bytes would otherwise reach the HTML, JSON and CSV outputs as they are. The PGN
+// escapes of quotes and backslashes, which the parser keeps, are undone.
+func textTag(g *chess.Game, key string) string {
+	return strings.ToValidUTF8(tagUnescaper.Replace(acpl.TagValue(g, key)), "\uFFFD")
+}
+
+// turningPointLabel names the turning point's move followed by the player's ACPL around it, leaving out
+// a side without any of the player's moves
+func turningPointLabel(g *chess.Game, tp acpl.TurningPoint) string {
+	var around []string
+	if tp.HasBefore {
+		around = append(around, fmt.Sprintf("%.0f ACPL before", tp.Before))
+	}
+	if tp.HasAfter {
+		if tp.HasBefore {
+			around = append(around, fmt.Sprintf("%.0f after", tp.After))
+		} else {
+			around = append(around, fmt.Sprintf("%.0f ACPL after", tp.After))
+		}
+	}
+
+	label := acpl.MoveLabel(g, tp.Ply)
+	if len(around) > 0 {
+		label += " (" + strings.Join(around, ", ") + ")"
+	}
+	return label
+}
+
+// buildRow shapes a ranked game for display
+func buildRow(r acpl.GameACPL, rank int) GameRow {
+	g := r.Game
+	resultWhite, resultBlack, _ := strings.Cut(acpl.TagValue(g, "Result"), "-")
+	formattedDate := ""
+	if t, err := time.Parse("2006.01.02", acpl.TagValue(g, "Date")); err == nil {
+		formattedDate = t.Format("Jan 2, 2006")
+	}
+	url := acpl.TagValue(g, "Site")
+
+	// study and broadcast exports may not link to a game
+	if !strings.HasPrefix(url, "http") {
+		url = ""
+	}
+
+	worstLoss, worstMove := 0.0, ""
+	if r.HasWorst {
+		worstLoss = r.Worst.Loss
+		worstMove = acpl.MoveLabel(g, r.Worst.Ply)
+	}
+
+	savedFrom := ""
+	if r.HasLowest && r.Lowest <= -savesThreshold && acpl.Won(g, r.IsWhite) {
+		savedFrom = fmt.Sprintf("%+.1f after %s", r.Lowest/100, acpl.MoveLabel(g, r.LowestPly))
+	}
+
+	turningPoint := ""
+	if r.HasTurningPoint {
+		turningPoint = turningPointLabel(g, r.TurningPoint)
+	}
+
+	ratingChange, hasRatingChange := acpl.RatingChange(g, r.IsWhite)
+
+	leftTheory := ""
+	if r.HasTheoryPlies {
+		leftTheory = acpl.MoveLabel(g, r.TheoryPlies)
+	}
+
+	return GameRow{
+		GameId:          acpl.GameKey(g),
+		Rank:            rank,
+		ACPL:            r.ACPL,
+		Score:           r.Score,
+		WorstLoss:       worstLoss,
+		WorstMove:       worstMove,
+		OpponentACPL:    r.OpponentACPL,
+		HasOpponentACPL: r.HasOpponentACPL,
+		RatingChange:    ratingChange,
+		HasRatingChange: hasRatingChange,
+		Blunders:        r.Blunders,
+		SavedFrom:       savedFrom,
+		Suspect:         r.Suspect,
+		TurningPoint:    turningPoint,
+		TheoryPlies:     r.TheoryPlies,
+		LeftTheory:      leftTheory,
+		FormattedDate:   formattedDate,
+		White:           textTag(g, "White"),
+		WhiteElo:        acpl.TagValue(g, "WhiteElo"),
+		Black:           textTag(g, "Black"),
+		BlackElo:        acpl.TagValue(g, "BlackElo"),
+		ResultWhite:     resultWhite,
+		ResultBlack:     resultBlack,
+		Result:          acpl.TagValue(g, "Result"),
+		Opening:         strings.ToValidUTF8(openingName(g), "\uFFFD"),
+		Moves:           len(g.Moves()) / 2,
+		URL:             url,
+	}
+}
+
+// redirectUser sends lichess-style profile paths such as /@/username to the results with the form's defaults
+func redirectUser(w http.ResponseWriter, r *http.Request) {
+	username := r.PathValue("username")
+
+	if !usernamePattern.MatchString(username) {
+		http.Error(w, "Invalid username", http.StatusBadRequest)
+		return
+	}
+
+	query := defaultSearchForm(username)
+
+	http.Redirect(w, r, "/go?"+query.Encode(), http.StatusFound)
+}
+
+// How games with the same score are ranked, chosen by the ties parameter
+const (
+	TiesSequential = ""         // 1, 2, 3, 4
+	TiesStandard   = "standard" // 1, 2, 2, 4
+	TiesDense      = "dense"    // 1, 2, 2, 3
+)
+
+// tieRanks returns the ranks of the first limit results. Ties are neighbouring results with the same
+// score, which is their ACPL unless the search ranks by something else, and the same eligibility and
+// number of blunders, which some rankings sort by first.
+func tieRanks(results []acpl.GameACPL, limit int, ties string) []int {
+	ranks := make([]int, 0, min(limit, len(results)))
+
+	for i := 0; i < limit && i < len(results); i++ {
+		tied := i > 0 && results[i].Score == results[i-1].Score && results[i].Eligible == results[i-1].Eligible &&
+			results[i].Blunders == results[i-1].Blunders
+
+		switch {
+		case i == 0 || ties == TiesSequential || !tied && ties == TiesStandard:
+			ranks = append(ranks, i+1)
+		case !tied:
+			ranks = append(ranks, ranks[i-1]+1)
+		default:
+			ranks = append(ranks, ranks[i-1])
+		}
+	}
+
+	return ranks
+}
+
+// rowSeq yields rows for the first limit results, building each one on demand and ranking ties as ties says
+func rowSeq(results []acpl.GameACPL, limit int, ties string) iter.Seq[GameRow] {
+	return func(yield func(GameRow) bool) {
+		for i, rank := range tieRanks(results, limit, ties) {
+			if !yield(buildRow(results[i], rank)) {
+				return
+			}
+		}
+	}
+}
+
+// handleReady reports whether the server is up and how Lichess has been responding recently
+func handleReady(w http.ResponseWriter, r *http.Request) {
+	ratio, samples := lichessHealth.SuccessRatio()
+
+	status := "ok"
+	if ratio < degradedRatio {
+		status = "degraded"
+	}
+
+	setCacheHeaders(w)
+	writeJSON(w, struct {
+		Status          string  `json:"status"`
+		UpstreamSuccess float64 `json:"upstreamSuccessRatio"`
+		UpstreamSamples int     `json:"upstreamSamples"`
+	}{
+		Status:          status,
+		UpstreamSuccess: ratio,
+		UpstreamSamples: samples,
+	})
 }
 
 func serveForm(w http.ResponseWriter, r *http.Request) {
 	log.Printf("Serving form to %s", r.RemoteAddr)
 
 	setCacheHeaders(w)
-	if err := templates.ExecuteTemplate(w, "index.html", struct{}{}); err != nil {
+	if err := renderTemplate(w, "index.html", struct{}{}); err != nil {
 		log.Printf("Error rendering index template: %v", err)
 	}
 }
@@ -90,34 +634,140 @@ func serveForm(w http.ResponseWriter, r *http.Request) {
 func handleForm(w http.ResponseWriter, r *http.Request) {
 	log.Printf("Handling form for %s", r.RemoteAddr)
 
-	if r.Method != http.MethodPost {
+	// GET makes results shareable by URL
+	if r.Method != http.MethodPost && r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	if err := r.ParseForm(); err != nil {
-		http.Error(w, "Bad request", http.StatusBadRequest)
+	w.Header().Add("Vary", "Accept")
+
+	format, ok := negotiateFormat(r, resultsFormats)
+	if !ok {
+		notAcceptable(w, resultsFormats)
+		return
+	}
+
+	search, ok := parsePasteSearch(w, r)
+	if !ok {
 		return
 	}
 
-	log.Printf("Received form from %s: %+v", r.RemoteAddr, r.Form)
+	recentSearches.Record(search.Username)
+
+	page, results := buildResultsPage(r, search)
+
+	// a printed report is static, so it may be kept for printing again or previewing
+	if format == formatHTML && r.FormValue("print") == "true" {
+		w.Header().Set("Cache-Control", "private, max-age=300")
 
-	username := r.FormValue("username")
-	timeControl := r.FormValue("time_control")
-	ratedOnly := r.FormValue("rated_only")
-	excludeMiniatures := r.FormValue("exclude_miniatures")
+		if err := renderTemplate(w, "results-print.html", page); err != nil {
+			log.Printf("Error rendering print template: %v", err)
+		}
+		return
+	}
+
+	setCacheHeaders(w)
+
+	switch format {
+	case formatJSON:
+		writeJSON(w, page)
+	case formatCSV:
+		writeCSV(w, rowSeq(results, min(len(results), maxCSVResults), search.Ties))
+	case formatNDJSON:
+		writeNDJSON(w, rowSeq(results, min(len(results), maxCSVResults), search.Ties))
+	case formatPGN:
+		writePGN(w, results[:min(len(results), maxResults)], search.Options)
+	default:
+		if err := renderTemplate(w, "results.html", page); err != nil {
+			log.Printf("Error rendering results template: %v", err)
+		}
+	}
+}
+
+// handleTable renders only the results table, for pages that update it with fetch()
+func handleTable(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	search, ok := parsePasteSearch(w, r)
+	if !ok {
+		return
+	}
+
+	page, _ := buildResultsPage(r, search)
+
+	setCacheHeaders(w)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	if err := renderTemplate(w, "results-table", page); err != nil {
+		log.Printf("Error rendering results table template: %v", err)
+	}
+}
+
+// ResultsPage is what /go shows, as HTML or JSON. Its text fields carry usernames and Lichess error
+// text, so they stay plain strings for html/template to escape; never make them template.HTML.
+type ResultsPage struct {
+	Username             string       `json:"username"`
+	TimeControl          string       `json:"timeControl"`
+	TimeControlName      string       `json:"-"`
+	TimeControlCharacter string       `json:"-"`
+	Summary              string       `json:"summary,omitempty"`
+	Insights             []string     `json:"insights,omitempty"`
+	Results              []GameRow    `json:"results"`
+	Message              string       `json:"message,omitempty"`
+	ContinueToken        string       `json:"continueToken,omitempty"`
+	Numbers              NumberFormat `json:"-"`
+	Ratings              RatingFormat `json:"-"`
+	// Partial is set when older games were left out because the fetch budget is spent
+	Partial     bool   `json:"partial,omitempty"`
+	ContinueURL string `json:"-"`
+	BestURL     string `json:"-"`
+	PrintURL    string `json:"-"`
+	// Draws are the accurate draws, when the search asks for them
+	Draws            []GameRow `json:"draws,omitempty"`
+	AccurateDrawACPL float64   `json:"-"`
+	// Rejected are the games that could not be parsed, when the search asks for them
+	Rejected []acpl.RejectedGame `json:"rejected,omitempty"`
+	// Stale says when the games were fetched, when Lichess could not be reached and cached ones are shown
+	Stale string `json:"stale,omitempty"`
+	// Slice gives the average ACPL of the games, when the search is narrowed to a colour or an opening
+	Slice string `json:"slice,omitempty"`
+	// ShowRatingChange shows each game's rating change next to its ACPL
+	ShowRatingChange bool `json:"-"`
+}
+
+// buildResultsPage runs the search, returning the page along with every ranked game
+func buildResultsPage(r *http.Request, search Search) (ResultsPage, []acpl.GameACPL) {
 	message := ""
-	minPlies := 0
 
-	if excludeMiniatures == "true" {
-		minPlies = 40
+	noGamesMessage := "\n\nNo games found. Make sure the username is correct and that games with computer analysis are available."
+	if search.Tournament != "" {
+		noGamesMessage = "\n\nNo analysed games by " + search.Username + " were found in this tournament."
 	}
 
-	results, err := retrieveResults(username, timeControl, ratedOnly == "true", minPlies)
+	page, err := search.retrievePage(r.Context())
+
+	if err == nil && len(page.Results) == 0 {
+		if tc, ok := search.fallbackTimeControl(r.Context()); ok {
+			requested := strings.ReplaceAll(search.TimeControl, ",", " or ")
+
+			if !search.FallbackTimeControl {
+				noGamesMessage = fmt.Sprintf("\n\nNo analysed %s games were found. You play %s most, try searching it instead.", requested, tc)
+			} else if fallback, fallbackPage, ok := search.withFallback(r.Context(), tc); ok {
+				message += fmt.Sprintf("\n\nNo analysed %s games were found, so these are your %s games, the time control you play most.", requested, tc)
+				search, page = fallback, fallbackPage
+			}
+		}
+	}
+
+	results, continueToken := page.Results, page.Token
 
 	if err != nil {
 		log.Printf("Error retrieving results for %s: %v", r.RemoteAddr, err)
-		message = "Failed to retrieve games: " + err.Error()
+		message = friendlyError(err, "User not found.")
 		results = []acpl.GameACPL{}
 	}
 
@@ -128,37 +778,97 @@ func handleForm(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if len(results) == 0 {
-		message += "\n\nNo games found. Make sure the username is correct and that games with computer analysis are available."
-	}
-
-	rows := make([]GameRow, 0, limit)
-
-	for i := 0; i < limit; i++ {
-		r := results[i]
-		g := r.Game
-		resultParts := strings.SplitN(acpl.TagValue(g, "Result"), "-", 2)
-		t, _ := time.Parse("2006.01.02", acpl.TagValue(g, "Date"))
-
-		rows = append(rows, GameRow{
-			GameId:        acpl.TagValue(g, "GameId"),
-			Rank:          i + 1,
-			ACPL:          r.ACPL,
-			FormattedDate: t.Format("Jan 2, 2006"),
-			White:         acpl.TagValue(g, "White"),
-			WhiteElo:      acpl.TagValue(g, "WhiteElo"),
-			Black:         acpl.TagValue(g, "Black"),
-			BlackElo:      acpl.TagValue(g, "BlackElo"),
-			ResultWhite:   resultParts[0],
-			ResultBlack:   resultParts[1],
-			Opening:       strings.SplitN(acpl.TagValue(g, "Opening"), ",", 2)[0],
-			Moves:         len(g.Moves()) / 2,
-			URL:           acpl.TagValue(g, "Site"),
-		})
+		message += noGamesMessage
+	}
+
+	if page.Partial {
+		message += "\n\nOnly your most recent games were analysed, older ones were left out to keep the search short."
+	}
+
+	for _, reason := range slices.Sorted(maps.Keys(page.Excluded.Suspect)) {
+		message += fmt.Sprintf("\n\n%d games were left out as their evals look corrupted (%s).", page.Excluded.Suspect[reason], reason)
+	}
+
+	rows := slices.AppendSeq(make([]GameRow, 0, limit), rowSeq(results, limit, search.Ties))
+
+	var draws []GameRow
+	if search.AccurateDraws {
+		accurateDraws := acpl.AccurateDraws(results, accurateDrawACPL)
+		draws = slices.AppendSeq(make([]GameRow, 0, min(len(accurateDraws), maxResults)), rowSeq(accurateDraws, maxResults, TiesSequential))
+	}
+
+	var insights []string
+
+	if search.TimeControl == "all" || strings.Contains(search.TimeControl, ",") {
+		buckets := stats.MinGames(stats.ByTimeControl(results), minSampleGames)
+
+		// pointing out the worst time control takes two with enough games
+		sampled := slices.DeleteFunc(buckets, func(b stats.Bucket) bool { return b.InsufficientData })
+
+		if len(sampled) > 1 {
+			worst, _ := stats.Worst(sampled)
+			insights = append(insights, fmt.Sprintf("You play least accurately in %s, averaging %.0f ACPL over %d games.", worst.Key, worst.AverageACPL, worst.Games))
+		}
+	}
+
+	summary := stats.Summarize(results, stats.AggregateGames, minSampleGames)
+
+	if summary.White != nil && summary.Black != nil {
+		better, worse := "White", "Black"
+		betterACPL, worseACPL := summary.White.AverageACPL, summary.Black.AverageACPL
+		if betterACPL > worseACPL {
+			better, worse = worse, better
+			betterACPL, worseACPL = worseACPL, betterACPL
+		}
+
+		if worseACPL-betterACPL >= minColorGap {
+			insights = append(insights, fmt.Sprintf("You play more accurately with %s, averaging %.0f ACPL against %.0f with %s.", better, betterACPL, worseACPL, worse))
+		}
+	}
+
+	if summary.ExpectedPointsLost >= minPointsLost {
+		insights = append(insights, fmt.Sprintf("Your inaccuracies gave up about %.1f expected points over these %d games.", summary.ExpectedPointsLost, summary.Games))
+	}
+
+	if peers := summary.Peers; peers != nil && peers.Verdict != stats.PeersExpected && summary.Games >= minSampleGames {
+		insights = append(insights, fmt.Sprintf("Your average of %.0f ACPL is %s than the %.0f typical of players rated around %d.", summary.AverageACPL, peers.Verdict, peers.ExpectedACPL, peers.Rating))
+	}
+
+	// links would carry a paste in their URL, so pasted games get none
+	bestURL := ""
+	if len(results) > 0 && search.Paste == "" {
+		query := maps.Clone(search.Form)
+		query.Del("continue")
+		bestURL = "/best?" + query.Encode()
+	}
+
+	slice := ""
+	if label := search.sliceLabel(); label != "" && summary.Games > 0 && summary.Games >= minSampleGames {
+		slice = fmt.Sprintf("%s, you averaged %.0f ACPL over %d games.", label, summary.AverageACPL, summary.Games)
+	}
+
+	stale := ""
+	if !page.StaleSince.IsZero() {
+		stale = "Lichess could not be reached, so these results are from games fetched at " + page.StaleSince.UTC().Format("15:04 UTC on Jan 2") + "."
+	}
+
+	printURL := ""
+	if search.Paste == "" {
+		printQuery := maps.Clone(search.Form)
+		printQuery.Set("print", "true")
+		printURL = "/go?" + printQuery.Encode()
+	}
+
+	continueURL := ""
+	if continueToken != "" {
+		query := maps.Clone(search.Form)
+		query.Set("continue", continueToken)
+		continueURL = "/go?" + query.Encode()
 	}
 
 	timeControlCharacter := ""
 
-	switch timeControl {
+	switch search.TimeControl {
 	case "bullet":
 		timeControlCharacter = "➤"
 	case "blitz":
@@ -169,24 +879,29 @@ func handleForm(w http.ResponseWriter, r *http.Request) {
 		timeControlCharacter = "🐢"
 	}
 
-	data := struct {
-		Username             string
-		TimeControl          string
-		TimeControlCharacter string
-		Results              []GameRow
-		Message              string
-	}{
-		Username:             username,
-		TimeControl:          timeControl,
+	return ResultsPage{
+		Username:             search.Username,
+		TimeControl:          search.TimeControl,
+		TimeControlName:      strings.ReplaceAll(search.TimeControl, ",", " and "),
 		TimeControlCharacter: timeControlCharacter,
+		Summary:              search.summary(),
+		Insights:             insights,
 		Results:              rows,
+		Draws:                draws,
+		Rejected:             page.Excluded.Rejected,
+		Stale:                stale,
+		Slice:                slice,
+		ShowRatingChange:     search.Form.Get("rating_change") == "true",
+		AccurateDrawACPL:     accurateDrawACPL,
 		Message:              message,
-	}
-
-	setCacheHeaders(w)
-	if err := templates.ExecuteTemplate(w, "results.html", data); err != nil {
-		log.Printf("Error rendering results template: %v", err)
-	}
+		ContinueToken:        continueToken,
+		Partial:              page.Partial,
+		Numbers:              numberFormatFor(r),
+		Ratings:              ratingFormatFor(r),
+		ContinueURL:          continueURL,
+		BestURL:              bestURL,
+		PrintURL:             printURL,
+	}, results
 }
 
 func main() {
@@ -205,17 +920,75 @@ func main() {
 	http.HandleFunc("/favicon.png", func(w http.ResponseWriter, r *http.Request) { http.ServeFile(w, r, "favicon.png") })
 	http.HandleFunc("/", serveForm)
 	http.HandleFunc("/go", handleForm)
+	http.HandleFunc("/go/table", handleTable)
+	http.HandleFunc("/readyz", handleReady)
+	http.HandleFunc("/game", handleGame)
+	http.HandleFunc("/best", handleBest)
+	http.HandleFunc("/u/{username}", redirectUser)
+	http.HandleFunc("/@/{username}", redirectUser)
+	http.HandleFunc("/api/rank", handleRank)
+	http.HandleFunc("/api/summary", handleSummary)
+	http.HandleFunc("/api/surprise", handleSurprise)
+	http.HandleFunc("/api/timing", handleTiming)
+	http.HandleFunc("/api/losses", handleLosses)
+	http.HandleFunc("/api/progress", handleProgress)
+	http.HandleFunc("/api/history", handleHistory)
+	http.HandleFunc("/api/trend", handleTrend)
+	http.HandleFunc("/api/time-controls", handleTimeControls)
+	http.HandleFunc("/api/leaderboard", handleLeaderboard)
+	http.HandleFunc("/api/debug/scores", handleDebugScores)
+	http.HandleFunc("/api/debug/recent", handleDebugRecent)
 
 	println("Starting server")
 
+	var handler http.Handler = http.DefaultServeMux
+	handler = slow_requests.NewSlowRequests(envDuration("SLOW_REQUEST_THRESHOLD", 5*time.Second)).Middleware(handler)
+	handler = idempotency.NewIdempotency("/api/", envDuration("IDEMPOTENCY_TTL", 10*time.Minute), envInt("IDEMPOTENCY_MAX_ENTRIES", 1000)).Middleware(handler)
+	handler = cors.NewCORS("/api/", strings.Split(os.Getenv("CORS_ALLOWED_ORIGINS"), ",")).Middleware(handler)
+	handler = rate_limiter.NewRateLimiter(5, 10).Middleware(handler)
+
 	server := &http.Server{
 		Addr:         ":8080",
-		Handler:      rate_limiter.NewRateLimiter(5, 10).Middleware(http.DefaultServeMux),
+		Handler:      handler,
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 120 * time.Second,
 	}
 
-	log.Fatal(server.ListenAndServe())
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if len(prefetchUsernames) > 0 {
+		log.Printf("Prefetching games of %s every %s", strings.Join(prefetchUsernames, ", "), prefetchInterval)
+		go runPrefetch(ctx, prefetchUsernames, prefetchInterval, prefetchSpacing, refreshGames)
+	}
+
+	go func() {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	ln, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = serve(server, ln, os.Getenv("TLS_CERT_FILE"), os.Getenv("TLS_KEY_FILE"))
+	if !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
 
 	println("Server stopped")
 }
+
+// serve serves on ln over TLS, and HTTP/2, when both certFile and keyFile are set, and plain HTTP otherwise
+func serve(server *http.Server, ln net.Listener, certFile string, keyFile string) error {
+	if certFile != "" && keyFile != "" {
+		println("Serving over TLS")
+		return server.ServeTLS(ln, certFile, keyFile)
+	}
+
+	return server.Serve(ln)
+}
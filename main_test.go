@@ -0,0 +1,583 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"macg/app/acpl"
+	"macg/app/cache"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/notnil/chess"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// writeCert writes a self-signed certificate for 127.0.0.1 and its key to dir
+func writeCert(t *testing.T, dir string) (certFile string, keyFile string, cert *x509.Certificate) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err = x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return certFile, keyFile, cert
+}
+
+func TestServeTLS(t *testing.T) {
+	certFile, keyFile, cert := writeCert(t, t.TempDir())
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &http.Server{Handler: http.HandlerFunc(serveForm)}
+	t.Cleanup(func() { server.Close() })
+
+	go serve(server, ln, certFile, keyFile)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: roots},
+		ForceAttemptHTTP2: true,
+	}}
+
+	resp, err := client.Get("https://" + ln.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want 200", resp.StatusCode)
+	}
+	if resp.ProtoMajor != 2 {
+		t.Errorf("protocol = %s, want HTTP/2", resp.Proto)
+	}
+	if !strings.Contains(string(body), `<form action="/go"`) {
+		t.Errorf("body does not hold the form:\n%s", body)
+	}
+}
+
+func TestServePlain(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &http.Server{Handler: http.HandlerFunc(serveForm)}
+	t.Cleanup(func() { server.Close() })
+
+	go serve(server, ln, "", "")
+
+	resp, err := http.Get("http://" + ln.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want 200", resp.StatusCode)
+	}
+}
+
+// stubLichess points lichessURL at a server answering with handler, with empty caches, until the test ends
+func stubLichess(t *testing.T, handler http.HandlerFunc) {
+	t.Helper()
+
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	previousURL, previousGames, previousStale, previousParsed, previousCooldowns := lichessURL, gamesCache, staleGames, parsedGames, fetchCooldowns
+	t.Cleanup(func() {
+		lichessURL, gamesCache, staleGames, parsedGames, fetchCooldowns = previousURL, previousGames, previousStale, previousParsed, previousCooldowns
+	})
+
+	lichessURL = srv.URL
+	gamesCache = cache.NewCache[[]byte](time.Minute, 10)
+	staleGames = cache.NewCache[[]byte](time.Minute, 10)
+	parsedGames = cache.NewCache[*chess.Game](time.Minute, 10)
+	fetchCooldowns = cache.NewCache[struct{}](fetchCooldown, 10)
+}
+
+// servePGN answers every request for a user's games with the PGN in testdata/name
+func servePGN(t *testing.T, name string) http.HandlerFunc {
+	t.Helper()
+
+	pgn, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/api/games/user/") {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(pgn)
+	}
+}
+
+// checkGolden compares got with testdata/name, rewriting the file instead with -update
+func checkGolden(t *testing.T, name string, got string) {
+	t.Helper()
+
+	path := filepath.Join("testdata", name)
+
+	if *update {
+		if err := os.WriteFile(path, []byte(got), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got != string(want) {
+		t.Errorf("output differs from %s, run go test -update to see the difference:\n%s", path, got)
+	}
+}
+
+func postForm(handler http.HandlerFunc, form url.Values, accept string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/go", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if accept != "" {
+		r.Header.Set("Accept", accept)
+	}
+
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+func TestRedirectUser(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/u/{username}", redirectUser)
+	mux.HandleFunc("/@/{username}", redirectUser)
+
+	want := url.Values{
+		"username":            {"Magnus"},
+		"time_control":        {"blitz"},
+		"rated_only":          {"true"},
+		"exclude_miniatures":  {"true"},
+		"min_evaluated_plies": {"10"},
+	}
+
+	for _, path := range []string{"/u/Magnus", "/@/Magnus"} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+
+		if w.Code != http.StatusFound {
+			t.Fatalf("%s: status = %d, want 302", path, w.Code)
+		}
+
+		location, err := url.Parse(w.Header().Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if location.Path != "/go" || !reflect.DeepEqual(location.Query(), want) {
+			t.Errorf("%s redirects to %s, want /go?%s", path, location, want.Encode())
+		}
+	}
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/u/no%20spaces", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("invalid username: status = %d, want 400", w.Code)
+	}
+}
+
+func TestHandleFormNames(t *testing.T) {
+	stubLichess(t, servePGN(t, "names.pgn"))
+
+	const name = `Zoë "Z", Jr`
+	form := url.Values{"username": {"alice"}, "time_control": {"blitz"}}
+
+	t.Run("html", func(t *testing.T) {
+		body := postForm(handleForm, form, "text/html").Body.String()
+
+		if !strings.Contains(body, "Zoë &#34;Z&#34;, Jr") {
+			t.Errorf("page does not hold the escaped name:\n%s", body)
+		}
+	})
+
+	t.Run("json", func(t *testing.T) {
+		var data struct {
+			Results []GameRow `json:"results"`
+		}
+		if err := json.Unmarshal(postForm(handleForm, form, "application/json").Body.Bytes(), &data); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(data.Results) != 1 || data.Results[0].Black != name {
+			t.Errorf("results = %+v, want one game against %s", data.Results, name)
+		}
+	})
+
+	t.Run("csv", func(t *testing.T) {
+		records, err := csv.NewReader(postForm(handleForm, form, "text/csv").Body).ReadAll()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		black := slices.Index(records[0], "black")
+		if len(records) != 2 || black < 0 || records[1][black] != name {
+			t.Errorf("CSV = %q, want one game against %s", records, name)
+		}
+	})
+}
+
+// TestRenderTemplateReload serves pages concurrently while their templates are parsed again for each
+// request and rewritten on disk; run it with -race
+func TestRenderTemplateReload(t *testing.T) {
+	stubLichess(t, servePGN(t, "names.pgn"))
+
+	dir := t.TempDir()
+	var files []string
+	for _, name := range templateFiles {
+		content, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file := filepath.Join(dir, name)
+		if err := os.WriteFile(file, content, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, file)
+	}
+
+	previousFiles, previousReload := templateFiles, reloadTemplates
+	t.Cleanup(func() { templateFiles, reloadTemplates = previousFiles, previousReload })
+	templateFiles, reloadTemplates = files, true
+
+	index, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// edits replace the file whole, as editors saving it do, so that a parse never sees half of it
+	done := make(chan struct{})
+	edited := make(chan struct{})
+	go func() {
+		defer close(edited)
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			tmp := filepath.Join(dir, "index.html.tmp")
+			content := append(slices.Clip(index), fmt.Sprintf("<!-- edit %d -->\n", i)...)
+			if err := os.WriteFile(tmp, content, 0o644); err != nil {
+				t.Error(err)
+				return
+			}
+			if err := os.Rename(tmp, files[0]); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	form := url.Values{"username": {"alice"}, "time_control": {"blitz"}}
+
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for range 10 {
+				w := httptest.NewRecorder()
+				serveForm(w, httptest.NewRequest(http.MethodGet, "/", nil))
+				if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `<form action="/go"`) {
+					t.Errorf("form: status = %d, body:\n%s", w.Code, w.Body)
+				}
+
+				if w := postForm(handleForm, form, "text/html"); w.Code != http.StatusOK {
+					t.Errorf("results: status = %d, body:\n%s", w.Code, w.Body)
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(done)
+	<-edited
+}
+
+func TestHandleForm(t *testing.T) {
+	tests := []struct {
+		name   string
+		form   url.Values
+		accept string
+		golden string
+		// minGames overrides minSampleGames so that the insights on these few games show
+		minGames int
+	}{
+		{
+			name:   "html",
+			form:   url.Values{"username": {"alice"}, "time_control": {"blitz"}},
+			golden: "handle_form.html",
+		},
+		{
+			name:   "json",
+			form:   url.Values{"username": {"alice"}, "time_control": {"blitz"}},
+			accept: "application/json",
+			golden: "handle_form.json",
+		},
+		{
+			name:   "csv",
+			form:   url.Values{"username": {"alice"}, "time_control": {"blitz"}},
+			accept: "text/csv",
+			golden: "handle_form.csv",
+		},
+		{
+			name:     "white only",
+			form:     url.Values{"username": {"alice"}, "time_control": {"blitz"}, "color": {"white"}},
+			accept:   "application/json",
+			golden:   "handle_form_white.json",
+			minGames: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stubLichess(t, servePGN(t, "games.pgn"))
+
+			if tt.minGames > 0 {
+				previous := minSampleGames
+				minSampleGames = tt.minGames
+				t.Cleanup(func() { minSampleGames = previous })
+			}
+
+			w := postForm(handleForm, tt.form, tt.accept)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200: %s", w.Code, w.Body)
+			}
+
+			checkGolden(t, tt.golden, w.Body.String())
+		})
+	}
+}
+
+func TestHandleFormNoGames(t *testing.T) {
+	stubLichess(t, func(w http.ResponseWriter, r *http.Request) {})
+
+	w := postForm(handleForm, url.Values{"username": {"alice"}, "time_control": {"blitz"}}, "")
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "No games found.") {
+		t.Errorf("body does not say no games were found:\n%s", w.Body)
+	}
+}
+
+func TestHandleFormInvalid(t *testing.T) {
+	stubLichess(t, servePGN(t, "games.pgn"))
+
+	for _, form := range []url.Values{
+		{"username": {"a b"}, "time_control": {"blitz"}},
+		{"username": {"alice"}, "time_control": {"hyperbullet"}},
+		{"username": {"alice"}},
+	} {
+		if w := postForm(handleForm, form, ""); w.Code != http.StatusBadRequest {
+			t.Errorf("%v: status = %d, want 400", form, w.Code)
+		}
+	}
+}
+
+func TestHandleFormUserNotFound(t *testing.T) {
+	stubLichess(t, http.NotFound)
+
+	w := postForm(handleForm, url.Values{"username": {"nobody"}, "time_control": {"blitz"}}, "")
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "User not found.") {
+		t.Errorf("body does not say the user was not found:\n%s", w.Body)
+	}
+}
+
+func TestRenderTemplateEscapesMessage(t *testing.T) {
+	const message = `<script>alert("x")</script> not found`
+
+	tests := []struct {
+		name string
+		data any
+	}{
+		{"results.html", ResultsPage{Username: "alice", TimeControl: "blitz", Message: message}},
+		{"game.html", GameAnalysis{GameId: "abcdEFGH", Message: message}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			if err := renderTemplate(w, tt.name, tt.data); err != nil {
+				t.Fatal(err)
+			}
+
+			body := w.Body.String()
+			if strings.Contains(body, "<script>alert") || !strings.Contains(body, "&lt;script&gt;alert(&#34;x&#34;)&lt;/script&gt; not found") {
+				t.Errorf("message is not escaped:\n%s", body)
+			}
+		})
+	}
+}
+
+func TestBuildResultsPage(t *testing.T) {
+	tests := []struct {
+		name    string
+		lichess func(t *testing.T) http.HandlerFunc
+		check   func(t *testing.T, page ResultsPage, results []acpl.GameACPL)
+	}{
+		{
+			name:    "games",
+			lichess: func(t *testing.T) http.HandlerFunc { return servePGN(t, "games.pgn") },
+			check: func(t *testing.T, page ResultsPage, results []acpl.GameACPL) {
+				if page.Username != "alice" || page.TimeControl != "blitz" || page.TimeControlName != "blitz" || page.TimeControlCharacter != "🔥" {
+					t.Errorf("page is for %q in %q (%q, %q), want alice in blitz", page.Username, page.TimeControl, page.TimeControlName, page.TimeControlCharacter)
+				}
+				if len(results) != 2 || len(page.Results) != 2 || page.Results[0].GameId != "ijklMNOP" || page.Results[0].Rank != 1 {
+					t.Errorf("results = %+v, want ijklMNOP ranked first of 2", page.Results)
+				}
+				if page.Message != "" {
+					t.Errorf("Message = %q, want none", page.Message)
+				}
+				if page.BestURL != "/best?time_control=blitz&username=alice" || page.PrintURL != "/go?print=true&time_control=blitz&username=alice" || page.ContinueURL != "" {
+					t.Errorf("links = %q, %q, %q", page.BestURL, page.PrintURL, page.ContinueURL)
+				}
+			},
+		},
+		{
+			name:    "user not found",
+			lichess: func(t *testing.T) http.HandlerFunc { return http.NotFound },
+			check: func(t *testing.T, page ResultsPage, results []acpl.GameACPL) {
+				if len(results) != 0 || len(page.Results) != 0 {
+					t.Errorf("results = %+v, want none", page.Results)
+				}
+				if !strings.HasPrefix(page.Message, "User not found.") || !strings.Contains(page.Message, "No games found.") {
+					t.Errorf("Message = %q, want the user not found", page.Message)
+				}
+				if page.BestURL != "" {
+					t.Errorf("BestURL = %q, want none without games", page.BestURL)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stubLichess(t, tt.lichess(t))
+
+			form := url.Values{"username": {"alice"}, "time_control": {"blitz"}}
+			r := httptest.NewRequest(http.MethodGet, "/go?"+form.Encode(), nil)
+
+			search, ok := parseSearch(httptest.NewRecorder(), r)
+			if !ok {
+				t.Fatal("search was rejected")
+			}
+
+			page, results := buildResultsPage(r, search)
+			tt.check(t, page, results)
+		})
+	}
+}
+
+func TestFriendlyError(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		message string
+		status  int
+	}{
+		{"not found", &HTTPStatusError{StatusCode: http.StatusNotFound}, "User not found.", http.StatusNotFound},
+		{"rate limited", &HTTPStatusError{StatusCode: http.StatusTooManyRequests}, "Too many requests, try again shortly.", http.StatusTooManyRequests},
+		{"cooling down", &CooldownError{Username: "alice", Remaining: 20 * time.Second}, "Failed to retrieve games: games for alice were fetched moments ago, please try again in 20 seconds.", http.StatusTooManyRequests},
+		{"server error", &HTTPStatusError{StatusCode: http.StatusServiceUnavailable}, "Lichess is having trouble, try again later.", http.StatusBadGateway},
+		{"other status", &HTTPStatusError{StatusCode: http.StatusForbidden}, "Failed to retrieve games.", http.StatusBadGateway},
+		{"transport", &net.OpError{Op: "dial", Err: errors.New("connection refused")}, "Failed to retrieve games.", http.StatusBadGateway},
+		{"wrapped", fmt.Errorf("fetching: %w", &HTTPStatusError{StatusCode: http.StatusNotFound}), "User not found.", http.StatusNotFound},
+		{"expired continuation", ErrContinuationExpired, "Failed to retrieve games: " + ErrContinuationExpired.Error() + ".", http.StatusGone},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := friendlyError(tt.err, "User not found."); got != tt.message {
+				t.Errorf("friendlyError() = %q, want %q", got, tt.message)
+			}
+			if got := errorStatus(tt.err); got != tt.status {
+				t.Errorf("errorStatus() = %d, want %d", got, tt.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// exportNDJSON fetches games as JSON lines, whose embedded PGN may lack the evals of an analysed game
+const exportNDJSON = "ndjson"
+
+// lichessExportFormat is how users' games are fetched from Lichess, "pgn" or "ndjson"
+var lichessExportFormat = envString("LICHESS_EXPORT_FORMAT", "pgn")
+
+// maxPGNFallbacks caps how many games of an NDJSON export are fetched again as PGN for their evals
+var maxPGNFallbacks = envInt("MAX_PGN_FALLBACKS", 20)
+
+// Reasons for leaving a game of an NDJSON export out of the ranking
+const (
+	skipNotAnalysed    = "not analysed"
+	skipFallbackLimit  = "over the PGN fallback limit"
+	skipFallbackFailed = "PGN fallback failed"
+	skipRateLimited    = "rate limited"
+)
+
+// ndjsonGame is the part of a game in a Lichess NDJSON export needed to rank it
+type ndjsonGame struct {
+	Id  string `json:"id"`
+	PGN string `json:"pgn"`
+	// Analysis holds an eval per ply when the export asks for evals and the game was analysed
+	Analysis []json.RawMessage `json:"analysis"`
+	Players  map[string]struct {
+		Analysis *struct{} `json:"analysis"`
+	} `json:"players"`
+}
+
+// analysed reports whether Lichess analysed the game, which it shows with a summary per player
+func (g ndjsonGame) analysed() bool {
+	for _, p := range g.Players {
+		if p.Analysis != nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hasEvals reports whether the game's PGN carries the evals of its analysis
+func (g ndjsonGame) hasEvals() bool {
+	return len(g.Analysis) > 0 && strings.Contains(g.PGN, "[%eval ")
+}
+
+// fetchGamesNDJSON downloads a game export as NDJSON and returns its games as PGN. An analysed game
+// without evals is exported again on its own as PGN, one game at a time and at most maxPGNFallbacks of
+// them; once Lichess rate limits those exports the remaining such games are skipped, as are games that
+// were never analysed. Skipped games are counted by reason in the log.
+func fetchGamesNDJSON(ctx context.Context, url string) ([]byte, error) {
+	body, err := fetchLichessAs(ctx, url, "application/x-ndjson")
+
+	if err != nil {
+		return nil, err
+	}
+
+	var pgn bytes.Buffer
+	skipped := map[string]int{}
+	fallbacks := 0
+	rateLimited := false
+
+	dec := json.NewDecoder(bytes.NewReader(body))
+
+	for {
+		var g ndjsonGame
+		if err := dec.Decode(&g); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		game := g.PGN
+
+		switch {
+		case g.hasEvals():
+		case !g.analysed():
+			skipped[skipNotAnalysed]++
+			continue
+		case rateLimited:
+			skipped[skipRateLimited]++
+			continue
+		case fallbacks >= maxPGNFallbacks:
+			skipped[skipFallbackLimit]++
+			continue
+		default:
+			fallbacks++
+
+			exported, err := fetchLichess(ctx, gameExportURL(g.Id))
+
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+
+				var statusErr *HTTPStatusError
+				if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusTooManyRequests {
+					rateLimited = true
+					skipped[skipRateLimited]++
+				} else {
+					skipped[skipFallbackFailed]++
+				}
+
+				log.Printf("Error fetching game %s as PGN: %v", g.Id, err)
+				continue
+			}
+
+			game = string(exported)
+		}
+
+		pgn.WriteString(strings.TrimSpace(game))
+		pgn.WriteString("\n\n\n")
+	}
+
+	if fallbacks > 0 || len(skipped) > 0 {
+		log.Printf("Fetched %d games as PGN for their evals, skipped %v", fallbacks, skipped)
+	}
+
+	return pgn.Bytes(), nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"macg/app/acpl"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// commentPattern matches PGN comments, which hold the evals
+var commentPattern = regexp.MustCompile(`\{[^}]*\} `)
+
+// serveNDJSON exports the games of testdata/games.pgn as NDJSON: the first with its evals, the second
+// analysed but without evals and the third not analysed. Single games are exported as PGN and counted in
+// exports.
+func serveNDJSON(t *testing.T, exports *[]string) http.HandlerFunc {
+	t.Helper()
+
+	pgn, err := os.ReadFile(filepath.Join("testdata", "games.pgn"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	games := strings.Split(strings.TrimSpace(string(pgn)), "\n\n\n")
+
+	analysis := map[string]any{"white": map[string]any{"analysis": map[string]any{"acpl": 20}}}
+
+	var ndjson bytes.Buffer
+	enc := json.NewEncoder(&ndjson)
+	enc.Encode(map[string]any{"id": "abcdEFGH", "pgn": games[0], "analysis": []any{map[string]any{"eval": 30}}, "players": analysis})
+	enc.Encode(map[string]any{"id": "ijklMNOP", "pgn": commentPattern.ReplaceAllString(games[1], ""), "players": analysis})
+	enc.Encode(map[string]any{"id": "qrstUVWX", "pgn": games[2], "players": map[string]any{}})
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if id, ok := strings.CutPrefix(r.URL.Path, "/game/export/"); ok {
+			*exports = append(*exports, id)
+			w.Write([]byte(games[1]))
+			return
+		}
+
+		if r.Header.Get("Accept") != "application/x-ndjson" || r.URL.Query().Get("pgnInJson") != "true" {
+			t.Errorf("games requested as %q with %s, want NDJSON with the PGN", r.Header.Get("Accept"), r.URL.RawQuery)
+		}
+		w.Write(ndjson.Bytes())
+	}
+}
+
+func TestFetchGamesNDJSON(t *testing.T) {
+	tests := []struct {
+		name      string
+		fallbacks int
+		exports   []string
+		ranked    []string
+	}{
+		{"fallback", 20, []string{"ijklMNOP"}, []string{"abcdEFGH", "ijklMNOP"}},
+		{"over the fallback limit", 0, nil, []string{"abcdEFGH"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var exports []string
+			stubLichess(t, serveNDJSON(t, &exports))
+
+			previousFormat, previousFallbacks := lichessExportFormat, maxPGNFallbacks
+			t.Cleanup(func() { lichessExportFormat, maxPGNFallbacks = previousFormat, previousFallbacks })
+			lichessExportFormat, maxPGNFallbacks = exportNDJSON, tt.fallbacks
+
+			pgn, err := fetchGames(context.Background(), "alice", "blitz", false, time.Time{}, time.Time{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !slices.Equal(exports, tt.exports) {
+				t.Errorf("exported %v as PGN, want %v", exports, tt.exports)
+			}
+
+			results, err := acpl.RankByACPL(bytes.NewReader(pgn), "alice", acpl.Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var ranked []string
+			for _, r := range results {
+				if r.Count == 0 {
+					t.Errorf("%s has no evaluated moves", acpl.TagValue(r.Game, "GameId"))
+				}
+				ranked = append(ranked, acpl.TagValue(r.Game, "GameId"))
+			}
+			slices.Sort(ranked)
+
+			if !slices.Equal(ranked, tt.ranked) {
+				t.Errorf("ranked %v, want %v", ranked, tt.ranked)
+			}
+		})
+	}
+}
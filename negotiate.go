@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"iter"
+	"log"
+	"macg/app/acpl"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	formatHTML   = "html"
+	formatJSON   = "json"
+	formatCSV    = "csv"
+	formatPGN    = "pgn"
+	formatNDJSON = "ndjson"
+)
+
+var formatMediaTypes = map[string]string{
+	formatHTML:   "text/html",
+	formatJSON:   "application/json",
+	formatCSV:    "text/csv",
+	formatPGN:    "application/x-chess-pgn",
+	formatNDJSON: "application/x-ndjson",
+}
+
+// pageFormats are the formats of pages showing a single game
+var pageFormats = []string{formatHTML, formatJSON}
+
+// resultsFormats are the formats /go answers with, the first being the default
+var resultsFormats = outputFormats(envString("OUTPUT_FORMATS", "html,json,csv,ndjson,pgn"))
+
+// outputFormats reads a comma-separated list of formats, ignoring unknown ones
+func outputFormats(list string) []string {
+	var formats []string
+
+	for f := range strings.SplitSeq(list, ",") {
+		f = strings.ToLower(strings.TrimSpace(f))
+		if f == "" {
+			continue
+		}
+		if _, ok := formatMediaTypes[f]; !ok {
+			log.Printf("Ignoring unknown output format %q", f)
+			continue
+		}
+		formats = append(formats, f)
+	}
+
+	if len(formats) == 0 {
+		return []string{formatHTML}
+	}
+	return formats
+}
+
+// csvFlushRows is how many rows are buffered before flushing a CSV download
+const csvFlushRows = 100
+
+type preference struct {
+	value string
+	q     float64
+}
+
+// preferences lists the lowercased values of an Accept-style header, most preferred first,
+// leaving out those refused with q=0
+func preferences(header string) []string {
+	var prefs []preference
+
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		p := preference{value: strings.ToLower(strings.TrimSpace(params[0])), q: 1}
+
+		for _, param := range params[1:] {
+			if v, ok := strings.CutPrefix(strings.TrimSpace(param), "q="); ok {
+				if q, err := strconv.ParseFloat(v, 64); err == nil {
+					p.q = q
+				}
+			}
+		}
+
+		if p.value != "" && p.q > 0 {
+			prefs = append(prefs, p)
+		}
+	}
+
+	sort.SliceStable(prefs, func(i, j int) bool {
+		return prefs[i].q > prefs[j].q
+	})
+
+	values := make([]string, 0, len(prefs))
+	for _, p := range prefs {
+		values = append(values, p.value)
+	}
+
+	return values
+}
+
+// negotiateFormat picks one of formats from the Accept header, defaulting to the first one when there is
+// no header. It fails when the client accepts none of them, including when it refuses them all with q=0.
+func negotiateFormat(r *http.Request, formats []string) (string, bool) {
+	header := r.Header.Get("Accept")
+	if strings.TrimSpace(header) == "" {
+		return formats[0], true
+	}
+
+	accepted := preferences(header)
+
+	for _, pattern := range accepted {
+		for _, format := range formats {
+			if mediaTypeMatches(pattern, formatMediaTypes[format]) {
+				return format, true
+			}
+		}
+	}
+
+	return "", false
+}
+
+// mediaTypeMatches reports whether an Accept media range such as "text/*" covers mediaType
+func mediaTypeMatches(pattern string, mediaType string) bool {
+	if pattern == "*/*" || pattern == mediaType {
+		return true
+	}
+
+	prefix, ok := strings.CutSuffix(pattern, "*")
+	return ok && strings.HasSuffix(prefix, "/") && strings.HasPrefix(mediaType, prefix)
+}
+
+// notAcceptable replies 406 with the media types that could have been served
+func notAcceptable(w http.ResponseWriter, formats []string) {
+	mediaTypes := make([]string, 0, len(formats))
+	for _, f := range formats {
+		mediaTypes = append(mediaTypes, formatMediaTypes[f])
+	}
+
+	http.Error(w, "Not acceptable. Supported types: "+strings.Join(mediaTypes, ", "), http.StatusNotAcceptable)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error encoding JSON: %v", err)
+	}
+}
+
+// writeNDJSON streams rows as JSON Lines, one object per line, flushing after each one
+func writeNDJSON(w http.ResponseWriter, rows iter.Seq[GameRow]) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+
+	for row := range rows {
+		if err := enc.Encode(row); err != nil {
+			log.Printf("Error writing NDJSON: %v", err)
+			return
+		}
+
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+// writeCSV streams rows as they are produced, flushing regularly so memory stays bounded.
+// Headers are sent with the first flush, so errors past that point can only be logged.
+func writeCSV(w http.ResponseWriter, rows iter.Seq[GameRow]) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+
+	cw := csv.NewWriter(w)
+	flusher, _ := w.(http.Flusher)
+
+	flush := func() bool {
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			log.Printf("Error writing CSV: %v", err)
+			return false
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return true
+	}
+
+	cw.Write([]string{"rank", "game_id", "acpl", "opponent_acpl", "worst_move", "worst_loss", "date", "white", "white_elo", "black", "black_elo", "result", "opening", "moves", "url"})
+
+	written := 0
+
+	for row := range rows {
+		opponentACPL := ""
+		if row.HasOpponentACPL {
+			opponentACPL = strconv.FormatFloat(row.OpponentACPL, 'f', 1, 64)
+		}
+
+		cw.Write([]string{
+			strconv.Itoa(row.Rank),
+			row.GameId,
+			strconv.FormatFloat(row.ACPL, 'f', 1, 64),
+			opponentACPL,
+			row.WorstMove,
+			strconv.FormatFloat(row.WorstLoss, 'f', 0, 64),
+			row.FormattedDate,
+			csvText(row.White),
+			row.WhiteElo,
+			csvText(row.Black),
+			row.BlackElo,
+			row.Result,
+			csvText(row.Opening),
+			strconv.Itoa(row.Moves),
+			row.URL,
+		})
+
+		written++
+		if written%csvFlushRows == 0 && !flush() {
+			return
+		}
+	}
+
+	flush()
+}
+
+// csvText keeps a free-text cell from being read as a formula by spreadsheets. Quoting of commas,
+// quotes and newlines is left to encoding/csv.
+func csvText(s string) string {
+	if s != "" && strings.ContainsRune("=+-@\t\r", rune(s[0])) {
+		return "'" + s
+	}
+
+	return s
+}
+
+// writePGN sends the games with their moves annotated, ready to import into a Lichess study
+func writePGN(w http.ResponseWriter, results []acpl.GameACPL, opts acpl.Options) {
+	w.Header().Set("Content-Type", "application/x-chess-pgn; charset=utf-8")
+
+	for i, r := range results {
+		if i > 0 {
+			io.WriteString(w, "\n")
+		}
+
+		if _, err := io.WriteString(w, acpl.AnnotatedPGN(r.Game, opts)); err != nil {
+			log.Printf("Error writing PGN: %v", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestNegotiateFormat(t *testing.T) {
+	formats := []string{formatHTML, formatJSON, formatCSV}
+
+	tests := []struct {
+		accept string
+		want   string
+		ok     bool
+	}{
+		{"", formatHTML, true},
+		{"application/json", formatJSON, true},
+		{"Text/CSV", formatCSV, true},
+		{"text/csv;q=0.5, application/json", formatJSON, true},
+		{"application/json;q=0.2, text/csv;q=0.9", formatCSV, true},
+		{"text/*", formatHTML, true},
+		{"*/*", formatHTML, true},
+		{"application/x-ndjson, */*;q=0.1", formatHTML, true},
+		{"text/html;q=0, application/*", formatJSON, true},
+		{"application/x-chess-pgn", "", false},
+		{"text/html;q=0", "", false},
+		{"image/*", "", false},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/go", nil)
+		if tt.accept != "" {
+			r.Header.Set("Accept", tt.accept)
+		}
+
+		got, ok := negotiateFormat(r, formats)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("Accept %q: negotiateFormat() = %q, %v, want %q, %v", tt.accept, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestHandleFormFormats(t *testing.T) {
+	stubLichess(t, servePGN(t, "games.pgn"))
+	form := url.Values{"username": {"alice"}, "time_control": {"blitz"}}
+
+	tests := []struct {
+		accept      string
+		contentType string
+		// rows checks the body holds the two analysed games of alice
+		rows func(t *testing.T, body string)
+	}{
+		{
+			accept:      "",
+			contentType: "text/html",
+			rows: func(t *testing.T, body string) {
+				if !strings.Contains(body, "abcdEFGH") || !strings.Contains(body, "ijklMNOP") {
+					t.Errorf("page does not list both games:\n%s", body)
+				}
+			},
+		},
+		{
+			accept:      "application/json",
+			contentType: "application/json",
+			rows: func(t *testing.T, body string) {
+				var data struct {
+					Username string    `json:"username"`
+					Results  []GameRow `json:"results"`
+				}
+				if err := json.Unmarshal([]byte(body), &data); err != nil {
+					t.Fatal(err)
+				}
+				if data.Username != "alice" || len(data.Results) != 2 {
+					t.Errorf("JSON = %+v, want alice's 2 games", data)
+				}
+			},
+		},
+		{
+			accept:      "text/csv",
+			contentType: "text/csv",
+			rows: func(t *testing.T, body string) {
+				records, err := csv.NewReader(strings.NewReader(body)).ReadAll()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(records) != 3 || records[0][0] != "rank" {
+					t.Errorf("CSV = %v, want a header and 2 rows", records)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.contentType, func(t *testing.T) {
+			w := postForm(handleForm, form, tt.accept)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200", w.Code)
+			}
+			if got := w.Header().Get("Content-Type"); !strings.HasPrefix(got, tt.contentType) {
+				t.Errorf("Content-Type = %q, want %s", got, tt.contentType)
+			}
+			if vary := w.Header().Values("Vary"); !strings.Contains(strings.Join(vary, ","), "Accept") {
+				t.Errorf("Vary = %v, want Accept", vary)
+			}
+
+			tt.rows(t, w.Body.String())
+		})
+	}
+}
+
+func TestOutputFormats(t *testing.T) {
+	tests := []struct {
+		list string
+		want []string
+	}{
+		{"html,json,csv,ndjson,pgn", []string{formatHTML, formatJSON, formatCSV, formatNDJSON, formatPGN}},
+		{" JSON , csv,", []string{formatJSON, formatCSV}},
+		{"json,xml", []string{formatJSON}},
+		{"xml", []string{formatHTML}},
+		{"", []string{formatHTML}},
+	}
+
+	for _, tt := range tests {
+		if got := outputFormats(tt.list); !slices.Equal(got, tt.want) {
+			t.Errorf("outputFormats(%q) = %v, want %v", tt.list, got, tt.want)
+		}
+	}
+}
+
+func TestHandleFormNotAcceptable(t *testing.T) {
+	stubLichess(t, servePGN(t, "games.pgn"))
+
+	w := postForm(handleForm, url.Values{"username": {"alice"}, "time_control": {"blitz"}}, "image/png")
+
+	if w.Code != http.StatusNotAcceptable {
+		t.Fatalf("status = %d, want 406", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "application/json") {
+		t.Errorf("body does not list the supported types:\n%s", w.Body)
+	}
+}
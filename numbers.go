@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// NumberFormat writes numbers for display the way a locale expects them
+type NumberFormat struct {
+	Decimal string
+	// Thousands separates groups of digits in numbers of five digits or more
+	Thousands string
+}
+
+var defaultNumberFormat = NumberFormat{Decimal: "."}
+
+// numberFormats lists the languages that do not write numbers the default way
+var numberFormats = map[string]NumberFormat{
+	"de": {Decimal: ",", Thousands: "."},
+	"es": {Decimal: ",", Thousands: "."},
+	"fr": {Decimal: ",", Thousands: "\u202f"},
+	"it": {Decimal: ",", Thousands: "."},
+	"nl": {Decimal: ",", Thousands: "."},
+	"pl": {Decimal: ",", Thousands: "\u00a0"},
+	"pt": {Decimal: ",", Thousands: "."},
+	"ru": {Decimal: ",", Thousands: "\u00a0"},
+	"sv": {Decimal: ",", Thousands: "\u00a0"},
+	"tr": {Decimal: ",", Thousands: "."},
+	"uk": {Decimal: ",", Thousands: "\u00a0"},
+}
+
+// numberFormatFor reads the locale from the locale parameter, e.g. "de-DE", or else the Accept-Language header
+func numberFormatFor(r *http.Request) NumberFormat {
+	locales := preferences(r.Header.Get("Accept-Language"))
+	if locale := r.URL.Query().Get("locale"); locale != "" {
+		locales = []string{strings.ToLower(locale)}
+	}
+
+	for _, locale := range locales {
+		language, _, _ := strings.Cut(strings.ReplaceAll(locale, "_", "-"), "-")
+
+		if language == "en" || language == "*" {
+			break
+		}
+
+		if f, ok := numberFormats[language]; ok {
+			return f
+		}
+	}
+
+	return defaultNumberFormat
+}
+
+// Format writes v with the given number of digits after the decimal separator, e.g. "12,5"
+func (f NumberFormat) Format(v float64, digits int) string {
+	s := strconv.FormatFloat(v, 'f', digits, 64)
+
+	sign := ""
+	if s[0] == '-' {
+		sign, s = "-", s[1:]
+	}
+
+	whole, fraction, _ := strings.Cut(s, ".")
+
+	if len(whole) >= 5 && f.Thousands != "" {
+		var grouped strings.Builder
+		for i, digit := range whole {
+			if i > 0 && (len(whole)-i)%3 == 0 {
+				grouped.WriteString(f.Thousands)
+			}
+			grouped.WriteRune(digit)
+		}
+		whole = grouped.String()
+	}
+
+	if fraction == "" {
+		return sign + whole
+	}
+
+	return sign + whole + f.Decimal + fraction
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// prefetchUsernames are kept cached so that their results load instantly, e.g. for featured streamers
+var prefetchUsernames = validUsernames(opponentNames(os.Getenv("PREFETCH_USERNAMES")))
+
+// prefetchInterval is how often prefetchUsernames are fetched again. It should be shorter than CACHE_TTL.
+var prefetchInterval = envDuration("PREFETCH_INTERVAL", 5*time.Minute)
+
+// prefetchSpacing separates fetches so that prefetching a long list does not trip Lichess' rate limits
+var prefetchSpacing = envDuration("PREFETCH_SPACING", 5*time.Second)
+
+// validUsernames leaves out, and logs, names that are not valid Lichess usernames
+func validUsernames(names []string) []string {
+	var valid []string
+
+	for _, name := range names {
+		if !usernamePattern.MatchString(name) {
+			log.Printf("Ignoring invalid username %q", name)
+			continue
+		}
+		valid = append(valid, name)
+	}
+
+	return valid
+}
+
+// defaultSearchForm is the search profile links run, which is also the one prefetched
+func defaultSearchForm(username string) url.Values {
+	return url.Values{
+		"username":            {username},
+		"time_control":        {"blitz"},
+		"rated_only":          {"true"},
+		"exclude_miniatures":  {"true"},
+		"min_evaluated_plies": {"10"},
+	}
+}
+
+// runPrefetch refreshes each username straight away and then every interval, until ctx is done
+func runPrefetch(ctx context.Context, usernames []string, interval time.Duration, spacing time.Duration, refresh func(context.Context, string) error) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		for i, username := range usernames {
+			if i > 0 {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(spacing):
+				}
+			}
+
+			if err := refresh(ctx, username); err != nil && ctx.Err() == nil {
+				log.Printf("Error prefetching games of %s: %v", username, err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// refreshGames fetches the games of the default search for username into the cache, replacing any cached ones
+func refreshGames(ctx context.Context, username string) error {
+	s := searchFromForm(defaultSearchForm(username))
+
+	release, err := userFetches.Acquire(ctx, strings.ToLower(username))
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	pgn, err := fetchGames(ctx, s.Username, s.TimeControl, s.RatedOnly, s.Since, time.Time{})
+	if err != nil {
+		return err
+	}
+
+	storeGames(gamesCacheKey(s.Username, s.TimeControl, s.RatedOnly, s.Since), pgn)
+
+	return nil
+}
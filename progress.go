@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"log"
+	"macg/app/acpl"
+	"macg/app/stats"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var defaultProgressDays = 30
+
+// retrieveWindows ranks the search's games from the two consecutive windows of days before now.
+// Both windows are fetched separately so that each can hold up to maxGames games, and cached together.
+func (s Search) retrieveWindows(ctx context.Context, now time.Time, days int) (previous []acpl.GameACPL, recent []acpl.GameACPL, err error) {
+	start := lastDaysSince(now, 2*days)
+	middle := lastDaysSince(now, days)
+	key := "progress|" + gamesCacheKey(s.Username, s.TimeControl, s.RatedOnly, start) + "|" + strconv.Itoa(days)
+
+	pgn, _, err := cachedPGN(ctx, key, s.Username, func(ctx context.Context) ([]byte, error) {
+		recentPGN, err := fetchGames(ctx, s.Username, s.TimeControl, s.RatedOnly, middle, time.Time{})
+
+		if err != nil {
+			return nil, err
+		}
+
+		previousPGN, err := fetchGames(ctx, s.Username, s.TimeControl, s.RatedOnly, start, middle)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return append(append(recentPGN, "\n\n\n"...), previousPGN...), nil
+	})
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	results, _, err := rankPGN(ctx, pgn, s.Username, s.Options)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, r := range results {
+		if t, ok := acpl.GameTime(r.Game); ok && t.Before(middle) {
+			previous = append(previous, r)
+		} else {
+			recent = append(recent, r)
+		}
+	}
+
+	return previous, recent, nil
+}
+
+// handleProgress compares the user's last days (30 by default) with the days before them
+func handleProgress(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Handling progress for %s", r.RemoteAddr)
+
+	search, ok := parseSearch(w, r)
+	if !ok {
+		return
+	}
+
+	days := defaultProgressDays
+	if d := r.FormValue("days"); d != "" {
+		var err error
+		days, err = strconv.Atoi(d)
+
+		if err != nil || days < 1 || days > maxLastDays {
+			writeJSONError(w, http.StatusBadRequest, "days must be between 1 and "+strconv.Itoa(maxLastDays))
+			return
+		}
+	}
+
+	previous, recent, err := search.retrieveWindows(r.Context(), time.Now(), days)
+
+	if err != nil {
+		log.Printf("Error retrieving results for %s: %v", r.RemoteAddr, err)
+		writeJSONError(w, errorStatus(err), friendlyError(err, "User not found."))
+		return
+	}
+
+	aggregate := r.FormValue("aggregate")
+
+	setCacheHeaders(w)
+	writeJSON(w, stats.Compare(stats.Summarize(previous, aggregate, minSampleGames), stats.Summarize(recent, aggregate, minSampleGames), minSampleGames))
+}
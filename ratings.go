@@ -0,0 +1,54 @@
+package main
+
+import (
+	"macg/app/acpl"
+	"net/http"
+)
+
+// RatingFormat writes ratings for display, as raw numbers or as named tiers
+type RatingFormat struct {
+	Tiers bool
+}
+
+type ratingTier struct {
+	from  int
+	label string
+}
+
+// ratingTiers follow the US Chess classes, highest first
+var ratingTiers = []ratingTier{
+	{2400, "Senior Master 2400+"},
+	{2200, "Master 2200-2399"},
+	{2000, "Expert 2000-2199"},
+	{1800, "Class A 1800-1999"},
+	{1600, "Class B 1600-1799"},
+	{1400, "Class C 1400-1599"},
+	{1200, "Class D 1200-1399"},
+	{0, "Novice under 1200"},
+}
+
+// Label returns the rating from a WhiteElo or BlackElo tag, or its tier. Ratings that cannot be read are
+// returned as they are.
+func (f RatingFormat) Label(tag string) string {
+	elo, _, ok := acpl.ParseElo(tag)
+	if !f.Tiers || !ok {
+		return tag
+	}
+
+	return ratingTierLabel(elo)
+}
+
+func ratingTierLabel(elo int) string {
+	for _, t := range ratingTiers {
+		if elo >= t.from {
+			return t.label
+		}
+	}
+
+	return ratingTiers[len(ratingTiers)-1].label
+}
+
+// ratingFormatFor shows tiers when the ratings parameter is "tiers"
+func ratingFormatFor(r *http.Request) RatingFormat {
+	return RatingFormat{Tiers: r.FormValue("ratings") == "tiers"}
+}
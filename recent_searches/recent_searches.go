@@ -0,0 +1,82 @@
+package recent_searches
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RecentSearches remembers the usernames searched most recently, forgetting the oldest once full
+type RecentSearches struct {
+	mu      sync.Mutex
+	entries []Entry
+	next    int
+	full    bool
+
+	// salt keys the hashes of anonymized usernames, so that they cannot be looked up but stay the same
+	// for a user, whatever the case, until the server restarts
+	salt []byte
+}
+
+// Entry is a searched username and when it was searched
+type Entry struct {
+	Username string    `json:"username"`
+	At       time.Time `json:"at"`
+}
+
+// NewRecentSearches remembers up to capacity searches; a capacity of 0 or less remembers none
+func NewRecentSearches(capacity int) *RecentSearches {
+	salt := make([]byte, 32)
+	rand.Read(salt)
+
+	return &RecentSearches{entries: make([]Entry, max(0, capacity)), salt: salt}
+}
+
+// Record notes that username was just searched
+func (s *RecentSearches) Record(username string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.entries) == 0 {
+		return
+	}
+
+	s.entries[s.next] = Entry{Username: username, At: time.Now()}
+	s.next = (s.next + 1) % len(s.entries)
+	s.full = s.full || s.next == 0
+}
+
+// List returns the searches remembered, most recent first. When anonymize is set, usernames are
+// replaced by a hash of them.
+func (s *RecentSearches) List(anonymize bool) []Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count := s.next
+	if s.full {
+		count = len(s.entries)
+	}
+
+	list := make([]Entry, 0, count)
+	for i := 1; i <= count; i++ {
+		e := s.entries[(s.next-i+len(s.entries))%len(s.entries)]
+
+		if anonymize {
+			e.Username = s.hash(e.Username)
+		}
+
+		list = append(list, e)
+	}
+
+	return list
+}
+
+func (s *RecentSearches) hash(username string) string {
+	mac := hmac.New(sha256.New, s.salt)
+	mac.Write([]byte(strings.ToLower(username)))
+	return hex.EncodeToString(mac.Sum(nil))[:16]
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// SearchRequest is a search sent as a JSON body, with the same fields as the form
+type SearchRequest struct {
+	Username            string   `json:"username"`
+	TimeControls        []string `json:"time_controls"`
+	TimeControl         string   `json:"time_control"`
+	RatedOnly           bool     `json:"rated_only"`
+	Tournament          string   `json:"tournament"`
+	Continue            string   `json:"continue"`
+	PGN                 string   `json:"pgn"`
+	LastDays            int      `json:"last_days"`
+	Sort                string   `json:"sort"`
+	Ties                string   `json:"ties"`
+	FallbackTimeControl bool     `json:"fallback_time_control"`
+	ExcludeMiniatures   bool     `json:"exclude_miniatures"`
+	MinEvaluatedPlies   int      `json:"min_evaluated_plies"`
+	MaxMoves            int      `json:"max_moves"`
+	FromMove            int      `json:"from_move"`
+	SkipLastPlies       int      `json:"skip_last_plies"`
+	NoiseFloor          int      `json:"noise_floor"`
+	WinSteepness        float64  `json:"win_steepness"`
+	IgnoreResignation   bool     `json:"ignore_resignation"`
+	CriticalOnly        bool     `json:"critical_only"`
+	ContestedOnly       bool     `json:"contested_only"`
+	ExcludeUnchanged    bool     `json:"exclude_unchanged"`
+	MaterialWeighting   bool     `json:"material_weighting"`
+	EvaluateFirstMove   bool     `json:"evaluate_first_move"`
+	SkipBook            bool     `json:"skip_book"`
+	ExcludeSuspect      bool     `json:"exclude_suspect"`
+	StrictPGN           bool     `json:"strict_pgn"`
+	ExcludeProvisional  bool     `json:"exclude_provisional"`
+	ExcludeFlagged      bool     `json:"exclude_flagged"`
+	ExcludeRecaptures   bool     `json:"exclude_recaptures"`
+	ExcludePremoves     bool     `json:"exclude_premoves"`
+	TheoryDepth         bool     `json:"theory_depth"`
+	SavesOnly           bool     `json:"saves_only"`
+	ConversionOnly      bool     `json:"conversion_only"`
+	AccurateDraws       bool     `json:"accurate_draws"`
+	MinBaseMinutes      int      `json:"min_base_minutes"`
+	MinDurationMinutes  int      `json:"min_duration_minutes"`
+	KeepUnknownDuration bool     `json:"keep_unknown_duration"`
+	ReachedMove         int      `json:"reached_move"`
+	EndedBeforeMove     int      `json:"ended_before_move"`
+	MinRating           int      `json:"min_rating"`
+	ExcludeOpponents    []string `json:"exclude_opponents"`
+	Bots                string   `json:"bots"`
+	Color               string   `json:"color"`
+	Opening             string   `json:"opening"`
+	OnlyTerminations    []string `json:"only_termination"`
+	ExcludeTerminations []string `json:"exclude_termination"`
+	Line                string   `json:"line"`
+	LineTranspositions  bool     `json:"line_transpositions"`
+	// UpsetMargin and ConsistencyWeight are pointers as 0 is meaningful
+	UpsetMargin       *int     `json:"upset_margin"`
+	ConsistencyWeight *float64 `json:"consistency_weight"`
+	// Ratings is "tiers" to show ratings as categories, and RatingChange shows each game's rating change
+	Ratings      string `json:"ratings"`
+	RatingChange bool   `json:"rating_change"`
+	// Aggregate, By, Days and Seed are read by some API endpoints
+	Aggregate string `json:"aggregate"`
+	By        string `json:"by"`
+	Days      int    `json:"days"`
+	Seed      uint64 `json:"seed"`
+}
+
+// isJSON reports whether the request body is JSON
+func isJSON(r *http.Request) bool {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return mediaType == "application/json"
+}
+
+// decodeSearchRequest reads a JSON body into r.Form, alongside any query parameters, so that JSON
+// searches go through the same validation as forms
+func decodeSearchRequest(r *http.Request) error {
+	var req SearchRequest
+
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+
+	if err := dec.Decode(&req); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return err
+		}
+		return errors.New("malformed JSON: " + err.Error())
+	}
+
+	for key, values := range req.values() {
+		r.Form[key] = values
+	}
+
+	return nil
+}
+
+// values encodes the request as the equivalent form, leaving out unset fields
+func (req SearchRequest) values() url.Values {
+	v := url.Values{}
+
+	set := func(key string, value string) {
+		if value != "" {
+			v.Set(key, value)
+		}
+	}
+	setBool := func(key string, value bool) {
+		if value {
+			v.Set(key, "true")
+		}
+	}
+	setInt := func(key string, value int) {
+		if value != 0 {
+			v.Set(key, strconv.Itoa(value))
+		}
+	}
+
+	set("username", req.Username)
+	for _, tc := range req.TimeControls {
+		v.Add("time_control", tc)
+	}
+	if req.TimeControl != "" {
+		v.Add("time_control", req.TimeControl)
+	}
+	setBool("rated_only", req.RatedOnly)
+	set("tournament", req.Tournament)
+	set("continue", req.Continue)
+	set("pgn", req.PGN)
+	setInt("last_days", req.LastDays)
+	set("sort", req.Sort)
+	set("ties", req.Ties)
+	setBool("fallback_time_control", req.FallbackTimeControl)
+	setBool("exclude_miniatures", req.ExcludeMiniatures)
+	setInt("min_evaluated_plies", req.MinEvaluatedPlies)
+	setInt("max_moves", req.MaxMoves)
+	setInt("from_move", req.FromMove)
+	setInt("skip_last_plies", req.SkipLastPlies)
+	setInt("noise_floor", req.NoiseFloor)
+	if req.WinSteepness != 0 {
+		v.Set("win_steepness", strconv.FormatFloat(req.WinSteepness, 'g', -1, 64))
+	}
+	setBool("ignore_resignation", req.IgnoreResignation)
+	setBool("critical_only", req.CriticalOnly)
+	setBool("contested_only", req.ContestedOnly)
+	setBool("exclude_unchanged", req.ExcludeUnchanged)
+	setBool("material_weighting", req.MaterialWeighting)
+	setBool("evaluate_first_move", req.EvaluateFirstMove)
+	setBool("skip_book", req.SkipBook)
+	setBool("exclude_suspect", req.ExcludeSuspect)
+	setBool("strict_pgn", req.StrictPGN)
+	setBool("exclude_provisional", req.ExcludeProvisional)
+	setBool("exclude_flagged", req.ExcludeFlagged)
+	setBool("exclude_recaptures", req.ExcludeRecaptures)
+	setBool("exclude_premoves", req.ExcludePremoves)
+	setBool("theory_depth", req.TheoryDepth)
+	setBool("saves_only", req.SavesOnly)
+	setBool("conversion_only", req.ConversionOnly)
+	setBool("accurate_draws", req.AccurateDraws)
+	setInt("min_base_minutes", req.MinBaseMinutes)
+	setInt("min_duration_minutes", req.MinDurationMinutes)
+	setBool("keep_unknown_duration", req.KeepUnknownDuration)
+	setInt("reached_move", req.ReachedMove)
+	setInt("ended_before_move", req.EndedBeforeMove)
+	setInt("min_rating", req.MinRating)
+	set("exclude_opponents", strings.Join(req.ExcludeOpponents, ","))
+	set("bots", req.Bots)
+	set("color", req.Color)
+	set("opening", req.Opening)
+	for _, t := range req.OnlyTerminations {
+		v.Add("only_termination", t)
+	}
+	for _, t := range req.ExcludeTerminations {
+		v.Add("exclude_termination", t)
+	}
+	set("line", req.Line)
+	setBool("line_transpositions", req.LineTranspositions)
+	if req.UpsetMargin != nil {
+		v.Set("upset_margin", strconv.Itoa(*req.UpsetMargin))
+	}
+	if req.ConsistencyWeight != nil {
+		v.Set("consistency_weight", strconv.FormatFloat(*req.ConsistencyWeight, 'g', -1, 64))
+	}
+	set("ratings", req.Ratings)
+	setBool("rating_change", req.RatingChange)
+	set("aggregate", req.Aggregate)
+	set("by", req.By)
+	setInt("days", req.Days)
+	if req.Seed != 0 {
+		v.Set("seed", strconv.FormatUint(req.Seed, 10))
+	}
+
+	return v
+}
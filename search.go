@@ -0,0 +1,592 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"macg/app/acpl"
+	"maps"
+	"math"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var criticalThreshold = 50.0
+var decidedThreshold = 600.0
+var savesThreshold = 300.0
+var winningThreshold = 300.0
+var defaultConsistencyWeight = 1.0
+
+// fallbackBookPlies is how many plies are taken as book moves when a game's book depth is unknown
+var fallbackBookPlies = 8
+
+// minRankedPlies is how many of the player's plies must be scored for a game to top the ranking
+var minRankedPlies = envInt("MIN_RANKED_PLIES", 15)
+var maxFormBytes int64 = 10 << 10
+var maxFieldLength = 100
+
+// fieldLengths overrides maxFieldLength for fields holding lists, which fit about 60 opponents' names
+// and an opening line of about 50 moves
+var fieldLengths = map[string]int{
+	"exclude_opponents": 2000,
+	"line":              1000,
+}
+
+// maxPasteBytes bounds the PGN pasted into the form, which is exempt from maxFieldLength
+var maxPasteBytes = int64(envInt("MAX_PASTE_BYTES", 256<<10))
+var maxLastDays = 3650
+
+// win_steepness may range from a third to three times Lichess's, see acpl.DefaultWinSteepness
+var minWinSteepness = 0.001
+var maxWinSteepness = 0.011
+
+// Lichess usernames are 2 to 30 letters, digits, underscores or hyphens
+var usernamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{2,30}$`)
+
+var validTimeControls = map[string]bool{
+	"all":            true,
+	"ultraBullet":    true,
+	"bullet":         true,
+	"blitz":          true,
+	"rapid":          true,
+	"classical":      true,
+	"correspondence": true,
+}
+
+// Search holds the parameters shared by the results page and the API
+type Search struct {
+	Username string
+	// TimeControl is "all" or a comma-separated list of time controls, any of which is searched
+	TimeControl string
+	RatedOnly   bool
+	// Since, when set, leaves out games played before it
+	Since time.Time
+	// Tournament is an arena or Swiss URL or ID; when set, TimeControl and RatedOnly are ignored
+	Tournament string
+	// Continue is a token from an earlier response to extend that analysis with older games
+	Continue string
+	// Paste is PGN pasted into the form. When set, its games are ranked instead of the user's Lichess
+	// games, and TimeControl, RatedOnly, Since and Tournament are ignored.
+	Paste string
+	// Ties is how games with the same score are ranked, see TiesSequential
+	Ties string
+	// FallbackTimeControl searches the time control the user plays most when there are no games in
+	// TimeControl; otherwise it is only suggested
+	FallbackTimeControl bool
+	// AccurateDraws lists drawn games both players played accurately apart from the ranking
+	AccurateDraws bool
+	Options       acpl.Options
+	// Form holds the raw parameters, to link to related searches
+	Form url.Values
+}
+
+// parseSearch reads and validates the search parameters, from a form or a JSON body, replying with an
+// error when they are invalid
+func parseSearch(w http.ResponseWriter, r *http.Request) (Search, bool) {
+	return parseSearchWithin(w, r, maxFormBytes)
+}
+
+// parsePasteSearch is parseSearch for the routes that rank pasted games, whose body may also hold a paste
+func parsePasteSearch(w http.ResponseWriter, r *http.Request) (Search, bool) {
+	return parseSearchWithin(w, r, maxFormBytes+maxPasteBytes)
+}
+
+// parseSearchWithin is parseSearch reading a body of at most maxBytes
+func parseSearchWithin(w http.ResponseWriter, r *http.Request, maxBytes int64) (Search, bool) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBytes)
+
+	err := r.ParseForm()
+	if err == nil && r.Method == http.MethodPost && isJSON(r) {
+		err = decodeSearchRequest(r)
+	}
+
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			searchError(w, r, http.StatusRequestEntityTooLarge, "Request too large")
+			return Search{}, false
+		}
+		searchError(w, r, http.StatusBadRequest, "Bad request: "+err.Error())
+		return Search{}, false
+	}
+
+	logged := r.Form
+	if r.Form.Has("pgn") {
+		// a paste is too long to log
+		logged = maps.Clone(r.Form)
+		logged.Set("pgn", fmt.Sprintf("(%d bytes)", len(r.Form.Get("pgn"))))
+	}
+	log.Printf("Received form from %s: %+v", r.RemoteAddr, logged)
+
+	if err := validateForm(r.Form); err != nil {
+		searchError(w, r, http.StatusBadRequest, "Bad request: "+err.Error())
+		return Search{}, false
+	}
+
+	return searchFromForm(r.Form), true
+}
+
+// searchError replies in JSON to JSON requests and in plain text otherwise
+func searchError(w http.ResponseWriter, r *http.Request, status int, message string) {
+	if isJSON(r) {
+		writeJSONError(w, status, message)
+		return
+	}
+
+	http.Error(w, message, status)
+}
+
+func searchFromForm(form url.Values) Search {
+	minEvaluatedPlies, _ := strconv.Atoi(form.Get("min_evaluated_plies"))
+	maxMoves, _ := strconv.Atoi(form.Get("max_moves"))
+
+	s := Search{
+		Username:    form.Get("username"),
+		TimeControl: timeControls(form["time_control"]),
+		RatedOnly:   form.Get("rated_only") == "true",
+		Tournament:  form.Get("tournament"),
+		Continue:    form.Get("continue"),
+		Paste:       strings.TrimSpace(form.Get("pgn")),
+		Ties:        form.Get("ties"),
+		Form:        form,
+
+		AccurateDraws:       form.Get("accurate_draws") == "true",
+		FallbackTimeControl: form.Get("fallback_time_control") == "true",
+		Options: acpl.Options{
+			IgnoreResignationLoss: form.Get("ignore_resignation") == "true",
+			CriticalOnly:          form.Get("critical_only") == "true",
+			CriticalThreshold:     criticalThreshold,
+			ContestedOnly:         form.Get("contested_only") == "true",
+			DecidedThreshold:      decidedThreshold,
+			ExcludeUnchanged:      form.Get("exclude_unchanged") == "true",
+			MaterialWeighting:     form.Get("material_weighting") == "true",
+			EvaluateFirstMove:     form.Get("evaluate_first_move") == "true",
+			SkipBook:              form.Get("skip_book") == "true",
+			ExcludeSuspect:        form.Get("exclude_suspect") == "true",
+			StrictPGN:             form.Get("strict_pgn") == "true",
+			ExcludeRecaptures:     form.Get("exclude_recaptures") == "true",
+			ExcludePremoves:       form.Get("exclude_premoves") == "true",
+			TheoryDepth:           form.Get("theory_depth") == "true",
+			FallbackBookPlies:     fallbackBookPlies,
+			SortBy:                form.Get("sort"),
+			ConsistencyWeight:     defaultConsistencyWeight,
+			MinRankedPlies:        minRankedPlies,
+		},
+	}
+
+	if days, err := strconv.Atoi(form.Get("last_days")); err == nil && days > 0 {
+		s.Since = lastDaysSince(time.Now(), days)
+	}
+
+	if k, err := strconv.ParseFloat(form.Get("consistency_weight"), 64); err == nil && k >= 0 && !math.IsInf(k, 0) {
+		s.Options.ConsistencyWeight = k
+	}
+
+	if form.Get("exclude_miniatures") == "true" {
+		s.Options.MinPlies = 40
+	}
+
+	if minEvaluatedPlies > 0 {
+		s.Options.MinEvaluatedPlies = minEvaluatedPlies
+	}
+
+	if maxMoves > 0 {
+		s.Options.MaxPlies = maxMoves * 2
+	}
+
+	if move, err := strconv.Atoi(form.Get("from_move")); err == nil && move > 1 {
+		s.Options.FromMove = move
+	}
+
+	if plies, err := strconv.Atoi(form.Get("skip_last_plies")); err == nil && plies > 0 {
+		s.Options.SkipLastPlies = plies
+	}
+
+	if floor, err := strconv.Atoi(form.Get("noise_floor")); err == nil && floor > 0 {
+		s.Options.NoiseFloor = float64(floor)
+	}
+
+	if steepness, err := strconv.ParseFloat(form.Get("win_steepness"), 64); err == nil {
+		s.Options.WinSteepness = steepness
+	}
+
+	if minutes, err := strconv.Atoi(form.Get("min_base_minutes")); err == nil && minutes > 0 {
+		s.Options.Filters = append(s.Options.Filters, acpl.MinBaseTime{Seconds: minutes * 60})
+	}
+
+	if minutes, err := strconv.Atoi(form.Get("min_duration_minutes")); err == nil && minutes > 0 {
+		s.Options.Filters = append(s.Options.Filters, acpl.MinDuration{
+			Min:         time.Duration(minutes) * time.Minute,
+			KeepUnknown: form.Get("keep_unknown_duration") == "true",
+		})
+	}
+
+	if form.Get("conversion_only") == "true" {
+		s.Options.ConvertingFrom = winningThreshold
+		s.Options.Filters = append(s.Options.Filters, acpl.Wins{})
+	}
+
+	if form.Get("saves_only") == "true" {
+		s.Options.Filters = append(s.Options.Filters, acpl.Saves{Threshold: savesThreshold})
+	}
+
+	if form.Get("exclude_provisional") == "true" {
+		s.Options.Filters = append(s.Options.Filters, acpl.Established{})
+	}
+
+	if form.Get("exclude_flagged") == "true" {
+		s.Options.Filters = append(s.Options.Filters, acpl.NotFlagged{})
+	}
+
+	switch form.Get("color") {
+	case "white":
+		s.Options.Filters = append(s.Options.Filters, acpl.Color{White: true})
+	case "black":
+		s.Options.Filters = append(s.Options.Filters, acpl.Color{})
+	}
+
+	if opening := strings.TrimSpace(form.Get("opening")); opening != "" {
+		s.Options.Filters = append(s.Options.Filters, acpl.OpeningFamily{Name: opening})
+	}
+
+	switch form.Get("bots") {
+	case "exclude":
+		s.Options.Filters = append(s.Options.Filters, acpl.Bots{})
+	case "only":
+		s.Options.Filters = append(s.Options.Filters, acpl.Bots{Only: true})
+	}
+
+	if names := opponentNames(form.Get("exclude_opponents")); len(names) > 0 {
+		s.Options.Filters = append(s.Options.Filters, acpl.ExcludeOpponents{Names: names})
+	}
+
+	if move, err := strconv.Atoi(form.Get("reached_move")); err == nil && move > 0 {
+		s.Options.Filters = append(s.Options.Filters, acpl.Phase{Move: move})
+	}
+
+	if move, err := strconv.Atoi(form.Get("ended_before_move")); err == nil && move > 0 {
+		s.Options.Filters = append(s.Options.Filters, acpl.Phase{Move: move, Before: true})
+	}
+
+	if values := form["only_termination"]; len(values) > 0 {
+		s.Options.Filters = append(s.Options.Filters, acpl.Terminations{Values: values})
+	}
+
+	if values := form["exclude_termination"]; len(values) > 0 {
+		s.Options.Filters = append(s.Options.Filters, acpl.Terminations{Values: values, Exclude: true})
+	}
+
+	if elo, err := strconv.Atoi(form.Get("min_rating")); err == nil && elo > 0 {
+		s.Options.Filters = append(s.Options.Filters, acpl.MinRating{Elo: elo})
+	}
+
+	if margin, err := strconv.Atoi(form.Get("upset_margin")); err == nil && margin >= 0 {
+		s.Options.Filters = append(s.Options.Filters, acpl.Upsets{Margin: margin})
+	}
+
+	if line, err := acpl.ParseLine(form.Get("line"), form.Get("line_transpositions") == "true"); err == nil {
+		s.Options.Filters = append(s.Options.Filters, line)
+	}
+
+	return s
+}
+
+// lastDaysSince returns when the last days before now began. It is rounded down to the hour so that
+// repeated searches share a cache entry.
+func lastDaysSince(now time.Time, days int) time.Time {
+	return now.Add(-time.Duration(days) * 24 * time.Hour).Truncate(time.Hour)
+}
+
+// opponentNames splits a comma-separated list of usernames, skipping blanks
+func opponentNames(list string) []string {
+	var names []string
+
+	for name := range strings.SplitSeq(list, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+// timeControls combines the values of the repeatable time_control field, e.g. blitz and rapid
+// into "blitz,rapid" as Lichess expects them. Any "all" overrides the others, and values are
+// sorted and deduplicated so that equivalent searches share a cache entry.
+func timeControls(values []string) string {
+	if slices.Contains(values, "all") {
+		return "all"
+	}
+
+	values = slices.Clone(values)
+	slices.Sort(values)
+
+	return strings.Join(slices.Compact(values), ",")
+}
+
+func (s Search) retrieve(ctx context.Context) ([]acpl.GameACPL, error) {
+	if s.Paste != "" {
+		return acpl.RankByACPLContext(ctx, strings.NewReader(s.Paste), s.Username, s.Options)
+	}
+
+	if s.Tournament != "" {
+		kind, id, _ := parseTournament(s.Tournament)
+		return retrieveTournamentResults(ctx, kind, id, s.Username, s.Options)
+	}
+
+	return retrieveResults(ctx, s.Username, s.TimeControl, s.RatedOnly, s.Since, s.Options)
+}
+
+// fallbackTimeControl returns the time control the user plays most outside of the search's, according
+// to their profile. Searches of every time control, a tournament, pasted games or older games have none.
+func (s Search) fallbackTimeControl(ctx context.Context) (string, bool) {
+	if s.TimeControl == "all" || s.Tournament != "" || s.Paste != "" || s.Continue != "" {
+		return "", false
+	}
+
+	counts, err := cachedTimeControls(ctx, s.Username)
+
+	if err != nil {
+		log.Printf("Error looking up time controls for %s: %v", s.Username, err)
+		return "", false
+	}
+
+	searched := strings.Split(s.TimeControl, ",")
+	for _, c := range counts {
+		if !slices.Contains(searched, c.TimeControl) {
+			return c.TimeControl, true
+		}
+	}
+
+	return "", false
+}
+
+// withFallback runs the search in timeControl instead, reporting whether it found any games
+func (s Search) withFallback(ctx context.Context, timeControl string) (Search, Page, bool) {
+	s.TimeControl = timeControl
+	s.Form = maps.Clone(s.Form)
+	s.Form["time_control"] = []string{timeControl}
+
+	page, err := s.retrievePage(ctx)
+
+	if err != nil {
+		log.Printf("Error retrieving fallback results for %s: %v", s.Username, err)
+		return s, Page{}, false
+	}
+
+	return s, page, len(page.Results) > 0
+}
+
+// sliceLabel names the colour and opening the search is narrowed to, e.g. "As Black in the French
+// Defense", or returns "" when it is not
+func (s Search) sliceLabel() string {
+	var label string
+
+	switch s.Form.Get("color") {
+	case "white":
+		label = "As White"
+	case "black":
+		label = "As Black"
+	}
+
+	if opening := strings.TrimSpace(s.Form.Get("opening")); opening != "" {
+		if label == "" {
+			label = "In the " + opening
+		} else {
+			label += " in the " + opening
+		}
+	}
+
+	return label
+}
+
+// summary describes the active filters, e.g. "rated games only, at least 20 moves"
+func (s Search) summary() string {
+	var parts []string
+	opts := s.Options
+
+	if s.Paste != "" {
+		parts = append(parts, "pasted games")
+	}
+
+	if s.RatedOnly {
+		parts = append(parts, "rated games only")
+	}
+
+	if !s.Since.IsZero() {
+		parts = append(parts, "played since "+s.Since.Format("Jan 2, 2006"))
+	}
+
+	if opts.MinPlies > 0 {
+		parts = append(parts, fmt.Sprintf("at least %d moves", opts.MinPlies/2))
+	}
+
+	if opts.MinEvaluatedPlies > 0 {
+		parts = append(parts, fmt.Sprintf("at least %d evaluated moves by the player", opts.MinEvaluatedPlies))
+	}
+
+	if opts.MaxPlies > 0 {
+		parts = append(parts, fmt.Sprintf("analysing only the first %d moves", opts.MaxPlies/2))
+	}
+
+	if opts.FromMove > 1 {
+		parts = append(parts, fmt.Sprintf("from move %d", opts.FromMove))
+	}
+
+	if opts.SkipLastPlies > 0 {
+		parts = append(parts, fmt.Sprintf("leaving out the last %d plies", opts.SkipLastPlies))
+	}
+
+	if opts.IgnoreResignationLoss {
+		parts = append(parts, "ignoring the final move of resigned lost games")
+	}
+
+	if opts.CriticalOnly {
+		parts = append(parts, fmt.Sprintf("counting only moves losing more than %.0f centipawns", opts.CriticalThreshold))
+	}
+
+	if opts.ContestedOnly {
+		parts = append(parts, fmt.Sprintf("leaving out moves once the eval was beyond %.0f centipawns", opts.DecidedThreshold))
+	}
+
+	if opts.WinSteepness > 0 {
+		parts = append(parts, fmt.Sprintf("winning chances with a steepness of %g", opts.WinSteepness))
+	}
+
+	if opts.NoiseFloor > 0 {
+		parts = append(parts, fmt.Sprintf("treating losses under %.0f centipawns as none", opts.NoiseFloor))
+	}
+
+	if opts.ConvertingFrom > 0 {
+		parts = append(parts, fmt.Sprintf("counting only moves once %.0f centipawns up", opts.ConvertingFrom))
+	}
+
+	if opts.SkipBook {
+		parts = append(parts, "leaving out opening book moves")
+	}
+
+	if opts.EvaluateFirstMove {
+		parts = append(parts, "counting the first move against an equal position")
+	}
+
+	if opts.MaterialWeighting {
+		parts = append(parts, "discounting moves made with a material imbalance")
+	}
+
+	if opts.ExcludeRecaptures {
+		parts = append(parts, "leaving out recaptures")
+	}
+
+	if opts.ExcludePremoves {
+		parts = append(parts, "leaving out premoves")
+	}
+
+	if opts.ExcludeSuspect {
+		parts = append(parts, "leaving out games whose evals look corrupted")
+	}
+
+	if opts.ExcludeUnchanged {
+		parts = append(parts, "leaving out moves that did not change the eval")
+	}
+
+	for _, f := range opts.Filters {
+		parts = append(parts, f.Describe())
+	}
+
+	if opts.SortBy == acpl.SortLengthAdjusted {
+		parts = append(parts, "favouring longer games")
+	}
+
+	if opts.SortBy == acpl.SortBlunders {
+		parts = append(parts, "ranked by fewest blunders, then by ACPL")
+	}
+
+	if opts.SortBy == acpl.SortGap {
+		parts = append(parts, "ranked by how much more accurate than the opponent, leaving out games where their moves were not analysed")
+	}
+
+	if opts.SortBy == acpl.SortSharpness {
+		parts = append(parts, "favouring games whose eval swung the most")
+	}
+
+	if opts.SortBy == acpl.SortConsistency {
+		parts = append(parts, fmt.Sprintf("ranked by ACPL + %g × the spread of move losses", opts.ConsistencyWeight))
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+// validateForm bounds every field before any of them reach the Lichess URL
+func validateForm(form url.Values) error {
+	for key, values := range form {
+		for _, v := range values {
+			if key == "pgn" {
+				if int64(len(v)) > maxPasteBytes {
+					return fmt.Errorf("pasted PGN is larger than %d KB", maxPasteBytes>>10)
+				}
+				continue
+			}
+			limit, ok := fieldLengths[key]
+			if !ok {
+				limit = maxFieldLength
+			}
+			if len(v) > limit {
+				return fmt.Errorf("%s is too long", key)
+			}
+		}
+	}
+
+	if !usernamePattern.MatchString(form.Get("username")) {
+		return errors.New("invalid username")
+	}
+
+	if len(form["time_control"]) == 0 {
+		return errors.New("invalid time control")
+	}
+
+	for _, tc := range form["time_control"] {
+		if !validTimeControls[tc] {
+			return errors.New("invalid time control")
+		}
+	}
+
+	if steepness := form.Get("win_steepness"); steepness != "" {
+		if s, err := strconv.ParseFloat(steepness, 64); err != nil || s < minWinSteepness || s > maxWinSteepness {
+			return fmt.Errorf("win_steepness must be between %g and %g", minWinSteepness, maxWinSteepness)
+		}
+	}
+
+	if color := form.Get("color"); color != "" && color != "any" && color != "white" && color != "black" {
+		return errors.New("invalid color")
+	}
+
+	if ties := form.Get("ties"); ties != TiesSequential && ties != TiesStandard && ties != TiesDense {
+		return errors.New("invalid ties")
+	}
+
+	if lastDays := form.Get("last_days"); lastDays != "" {
+		if days, err := strconv.Atoi(lastDays); err != nil || days < 1 || days > maxLastDays {
+			return fmt.Errorf("last_days must be between 1 and %d", maxLastDays)
+		}
+	}
+
+	if tournament := form.Get("tournament"); tournament != "" {
+		if _, _, ok := parseTournament(tournament); !ok {
+			return errors.New("invalid tournament")
+		}
+	}
+
+	if line := form.Get("line"); strings.TrimSpace(line) != "" {
+		if _, err := acpl.ParseLine(line, false); err != nil {
+			return fmt.Errorf("invalid line: %w", err)
+		}
+	}
+
+	return nil
+}
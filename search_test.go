@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestTimeControls(t *testing.T) {
+	tests := []struct {
+		values []string
+		want   string
+	}{
+		{[]string{"blitz"}, "blitz"},
+		{[]string{"rapid", "blitz"}, "blitz,rapid"},
+		{[]string{"blitz", "rapid", "blitz"}, "blitz,rapid"},
+		{[]string{"blitz", "all"}, "all"},
+	}
+
+	for _, tt := range tests {
+		if got := timeControls(tt.values); got != tt.want {
+			t.Errorf("timeControls(%q) = %q, want %q", tt.values, got, tt.want)
+		}
+	}
+}
+
+func TestHandleFormTimeControls(t *testing.T) {
+	tests := []struct {
+		name         string
+		timeControls []string
+		status       int
+		// perfType is what Lichess is asked for, "" when it is asked for every time control
+		perfType string
+	}{
+		{"combined", []string{"rapid", "blitz"}, http.StatusOK, "blitz,rapid"},
+		{"all", []string{"blitz", "all"}, http.StatusOK, ""},
+		{"one invalid", []string{"blitz", "hyperbullet"}, http.StatusBadRequest, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var perfTypes []string
+			games := servePGN(t, "games.pgn")
+			stubLichess(t, func(w http.ResponseWriter, r *http.Request) {
+				perfTypes = append(perfTypes, r.URL.Query().Get("perfType"))
+				games(w, r)
+			})
+
+			w := postForm(handleForm, url.Values{"username": {"alice"}, "time_control": tt.timeControls}, "")
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d", w.Code, tt.status)
+			}
+			if tt.status != http.StatusOK {
+				if len(perfTypes) > 0 {
+					t.Errorf("fetched %v for an invalid search", perfTypes)
+				}
+				return
+			}
+			if len(perfTypes) != 1 || perfTypes[0] != tt.perfType {
+				t.Errorf("perfType = %q, want %q", perfTypes, tt.perfType)
+			}
+		})
+	}
+}
+
+func TestValidateFormLengths(t *testing.T) {
+	// opponents is a list of 60 Lichess usernames of 30 characters
+	opponents := strings.TrimSuffix(strings.Repeat(strings.Repeat("a", 30)+",", 60), ",")
+	// line shuffles the knights out and back for 50 moves
+	var line strings.Builder
+	for move := 1; move <= 50; move++ {
+		if move%2 == 1 {
+			fmt.Fprintf(&line, "%d. Nf3 Nf6 ", move)
+		} else {
+			fmt.Fprintf(&line, "%d. Ng1 Ng8 ", move)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		key   string
+		value string
+		ok    bool
+	}{
+		{"long list of opponents", "exclude_opponents", opponents, true},
+		{"too many opponents", "exclude_opponents", opponents + "," + opponents, false},
+		{"long line", "line", line.String(), true},
+		{"too long a line", "line", line.String() + line.String(), false},
+		{"other field", "min_plies", strings.Repeat("1", maxFieldLength+1), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			form := url.Values{"username": {"alice"}, "time_control": {"blitz"}, tt.key: {tt.value}}
+
+			err := validateForm(form)
+			if tt.ok && err != nil {
+				t.Errorf("%d characters of %s: %v, want them accepted", len(tt.value), tt.key, err)
+			}
+			if !tt.ok && (err == nil || !strings.Contains(err.Error(), tt.key+" is too long")) {
+				t.Errorf("%d characters of %s: %v, want them refused as too long", len(tt.value), tt.key, err)
+			}
+		})
+	}
+}
+
+func TestHandleFormLimits(t *testing.T) {
+	stubLichess(t, servePGN(t, "games.pgn"))
+
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		form    url.Values
+		status  int
+	}{
+		{"oversized body", handleRank, url.Values{"username": {"alice"}, "time_control": {"blitz"}, "padding": {strings.Repeat("x", int(maxFormBytes))}}, http.StatusRequestEntityTooLarge},
+		{"oversized paste", handleForm, url.Values{"username": {"alice"}, "time_control": {"blitz"}, "pgn": {strings.Repeat("x", int(maxFormBytes+maxPasteBytes))}}, http.StatusRequestEntityTooLarge},
+		{"overlong username", handleForm, url.Values{"username": {strings.Repeat("a", 31)}, "time_control": {"blitz"}}, http.StatusBadRequest},
+		{"longest username", handleForm, url.Values{"username": {strings.Repeat("a", 30)}, "time_control": {"blitz"}}, http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := postForm(tt.handler, tt.form, ""); w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+}
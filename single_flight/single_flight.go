@@ -0,0 +1,76 @@
+package single_flight
+
+import (
+	"context"
+	"sync"
+)
+
+// Group runs one call at a time per key, sharing its result with every caller asking for that key
+// while it runs, so that identical requests arriving together cause one fetch
+type Group[T any] struct {
+	mu    sync.Mutex
+	calls map[string]*call[T]
+}
+
+// call is a running call; waiters counts the callers still waiting for it, so that it can be canceled
+// once none are left
+type call[T any] struct {
+	done    chan struct{}
+	val     T
+	err     error
+	waiters int
+	cancel  context.CancelFunc
+}
+
+func NewGroup[T any]() *Group[T] {
+	return &Group[T]{calls: make(map[string]*call[T])}
+}
+
+// Do runs fn for key unless a call for key is already running, in which case it waits for that call's
+// result. fn's context keeps ctx's values but is only canceled once every caller waiting for it is done,
+// so that one client going away does not fail the others. A caller whose ctx is done first gets its error.
+func (g *Group[T]) Do(ctx context.Context, key string, fn func(ctx context.Context) (T, error)) (T, error) {
+	g.mu.Lock()
+
+	c, ok := g.calls[key]
+	if !ok {
+		callCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		c = &call[T]{done: make(chan struct{}), cancel: cancel}
+		g.calls[key] = c
+
+		go func() {
+			c.val, c.err = fn(callCtx)
+
+			g.mu.Lock()
+			if g.calls[key] == c {
+				delete(g.calls, key)
+			}
+			g.mu.Unlock()
+
+			cancel()
+			close(c.done)
+		}()
+	}
+
+	c.waiters++
+	g.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return c.val, c.err
+	case <-ctx.Done():
+		g.mu.Lock()
+		c.waiters--
+		if c.waiters == 0 {
+			c.cancel()
+			// later callers start afresh rather than share a canceled call
+			if g.calls[key] == c {
+				delete(g.calls, key)
+			}
+		}
+		g.mu.Unlock()
+
+		var zero T
+		return zero, ctx.Err()
+	}
+}
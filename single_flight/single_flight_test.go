@@ -0,0 +1,174 @@
+package single_flight
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fetcher counts its calls and blocks each of them until release is closed or its context is canceled
+type fetcher struct {
+	calls   atomic.Int32
+	release chan struct{}
+	// canceled receives the context error of a call that was canceled
+	canceled chan error
+}
+
+func newFetcher() *fetcher {
+	return &fetcher{release: make(chan struct{}), canceled: make(chan error, 1)}
+}
+
+func (f *fetcher) fetch(ctx context.Context) (int, error) {
+	n := f.calls.Add(1)
+
+	select {
+	case <-f.release:
+		return int(n), nil
+	case <-ctx.Done():
+		f.canceled <- ctx.Err()
+		return 0, ctx.Err()
+	}
+}
+
+// waitForWaiters waits until n callers are waiting for the call for key
+func waitForWaiters(t *testing.T, g *Group[int], key string, n int) {
+	t.Helper()
+
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		g.mu.Lock()
+		c, ok := g.calls[key]
+		waiting := ok && c.waiters == n
+		g.mu.Unlock()
+
+		if waiting {
+			return
+		}
+	}
+
+	t.Fatalf("%d callers did not all wait for %s", n, key)
+}
+
+func TestDoShared(t *testing.T) {
+	g := NewGroup[int]()
+	f := newFetcher()
+
+	const callers = 10
+	results := make(chan int, callers)
+
+	var wg sync.WaitGroup
+	for range callers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			v, err := g.Do(context.Background(), "alice", f.fetch)
+			if err != nil {
+				t.Error(err)
+			}
+			results <- v
+		}()
+	}
+
+	waitForWaiters(t, g, "alice", callers)
+	close(f.release)
+	wg.Wait()
+	close(results)
+
+	if calls := f.calls.Load(); calls != 1 {
+		t.Errorf("fetched %d times, want once", calls)
+	}
+	for v := range results {
+		if v != 1 {
+			t.Errorf("result = %d, want the shared 1", v)
+		}
+	}
+}
+
+func TestDoKeys(t *testing.T) {
+	g := NewGroup[int]()
+	f := newFetcher()
+	close(f.release)
+
+	for _, key := range []string{"alice", "bob", "alice"} {
+		if _, err := g.Do(context.Background(), key, f.fetch); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// calls are only shared while they run
+	if calls := f.calls.Load(); calls != 3 {
+		t.Errorf("fetched %d times, want 3", calls)
+	}
+}
+
+func TestDoWaiterCanceled(t *testing.T) {
+	g := NewGroup[int]()
+	f := newFetcher()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	canceled := make(chan error)
+	go func() {
+		_, err := g.Do(ctx, "alice", f.fetch)
+		canceled <- err
+	}()
+
+	waiting := make(chan int)
+	go func() {
+		v, err := g.Do(context.Background(), "alice", f.fetch)
+		if err != nil {
+			t.Error(err)
+		}
+		waiting <- v
+	}()
+
+	waitForWaiters(t, g, "alice", 2)
+	cancel()
+
+	if err := <-canceled; err != context.Canceled {
+		t.Errorf("canceled caller got %v, want %v", err, context.Canceled)
+	}
+
+	// the other caller still waits for the call, which goes on
+	waitForWaiters(t, g, "alice", 1)
+	close(f.release)
+
+	if v := <-waiting; v != 1 {
+		t.Errorf("remaining caller got %d, want 1", v)
+	}
+	if calls := f.calls.Load(); calls != 1 {
+		t.Errorf("fetched %d times, want once", calls)
+	}
+	select {
+	case err := <-f.canceled:
+		t.Errorf("the call was canceled with %v while a caller waited for it", err)
+	default:
+	}
+}
+
+func TestDoAllCanceled(t *testing.T) {
+	g := NewGroup[int]()
+	f := newFetcher()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		_, err := g.Do(ctx, "alice", f.fetch)
+		done <- err
+	}()
+
+	waitForWaiters(t, g, "alice", 1)
+	cancel()
+	<-done
+
+	if err := <-f.canceled; err != context.Canceled {
+		t.Errorf("call ended with %v, want it canceled once nobody waits for it", err)
+	}
+
+	// a later caller starts a new call rather than share the canceled one
+	close(f.release)
+	if v, err := g.Do(context.Background(), "alice", f.fetch); err != nil || v != 2 {
+		t.Errorf("Do() = %d, %v, want a second call", v, err)
+	}
+}
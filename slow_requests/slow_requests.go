@@ -0,0 +1,62 @@
+package slow_requests
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type SlowRequests struct {
+	threshold time.Duration
+}
+
+// NewSlowRequests logs requests taking longer than threshold, or none when threshold is not positive
+func NewSlowRequests(threshold time.Duration) *SlowRequests {
+	return &SlowRequests{threshold: threshold}
+}
+
+// details is what handlers tell about a request, to be logged should it be slow
+type details struct {
+	mu       sync.Mutex
+	username string
+	games    int
+}
+
+type detailsKey struct{}
+
+// Note records the username a request searched and adds to how many games it ranked.
+// It does nothing outside of the middleware.
+func Note(ctx context.Context, username string, games int) {
+	d, ok := ctx.Value(detailsKey{}).(*details)
+	if !ok {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.username = username
+	d.games += games
+}
+
+func (s *SlowRequests) Middleware(next http.Handler) http.Handler {
+	if s.threshold <= 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		d := &details{}
+		start := time.Now()
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), detailsKey{}, d)))
+
+		if elapsed := time.Since(start); elapsed > s.threshold {
+			d.mu.Lock()
+			defer d.mu.Unlock()
+
+			log.Printf("Slow request: %s %s took %s (username %q, %d games)", r.Method, r.URL.Path, elapsed.Round(time.Millisecond), d.username, d.games)
+		}
+	})
+}
@@ -0,0 +1,496 @@
+package stats
+
+import (
+	"fmt"
+	"macg/app/acpl"
+	"math"
+	"sort"
+	"time"
+)
+
+// Bucket aggregates the ACPL of a group of games
+type Bucket struct {
+	Key         string  `json:"key"`
+	Games       int     `json:"games"`
+	AverageACPL float64 `json:"averageAcpl"`
+	// InsufficientData is set by MinGames on buckets with too few games to go by, whose AverageACPL is then
+	// zero, and by Series on periods without games
+	InsufficientData bool `json:"insufficientData,omitempty"`
+}
+
+// MinGames marks the buckets with fewer than minGames games as having insufficient data, clearing their
+// average so that a noisy one is not reported
+func MinGames(buckets []Bucket, minGames int) []Bucket {
+	for i := range buckets {
+		if buckets[i].Games < minGames {
+			buckets[i].AverageACPL = 0
+			buckets[i].InsufficientData = true
+		}
+	}
+
+	return buckets
+}
+
+// GroupBy buckets results by key, skipping games for which key returns ""; buckets are sorted by key
+func GroupBy(results []acpl.GameACPL, key func(acpl.GameACPL) string) []Bucket {
+	totals := make(map[string]*Bucket)
+
+	for _, r := range results {
+		k := key(r)
+		if k == "" {
+			continue
+		}
+
+		b, ok := totals[k]
+		if !ok {
+			b = &Bucket{Key: k}
+			totals[k] = b
+		}
+
+		b.Games++
+		b.AverageACPL += r.ACPL
+	}
+
+	buckets := make([]Bucket, 0, len(totals))
+	for _, b := range totals {
+		b.AverageACPL /= float64(b.Games)
+		buckets = append(buckets, *b)
+	}
+
+	sort.Slice(buckets, func(i, j int) bool {
+		return buckets[i].Key < buckets[j].Key
+	})
+
+	return buckets
+}
+
+func ByTimeControl(results []acpl.GameACPL) []Bucket {
+	return GroupBy(results, func(r acpl.GameACPL) string {
+		return acpl.TimeControlCategory(r.Game)
+	})
+}
+
+// Ways of averaging ACPL across games
+const (
+	// AggregateGames averages the games' ACPLs, so every game weighs the same whatever its length
+	AggregateGames = "games"
+	// AggregateMoves divides the total loss by the total number of counted moves, so longer games weigh more
+	AggregateMoves = "moves"
+)
+
+// ByHour buckets games by the UTC hour they started, keyed "00" to "23"; games without time tags are skipped
+func ByHour(results []acpl.GameACPL) []Bucket {
+	return GroupBy(results, func(r acpl.GameACPL) string {
+		t, ok := acpl.GameTime(r.Game)
+		if !ok {
+			return ""
+		}
+		return fmt.Sprintf("%02d", t.Hour())
+	})
+}
+
+// ByWeekday buckets games by the UTC weekday they started, from Monday to Sunday
+func ByWeekday(results []acpl.GameACPL) []Bucket {
+	buckets := GroupBy(results, func(r acpl.GameACPL) string {
+		t, ok := acpl.GameTime(r.Game)
+		if !ok {
+			return ""
+		}
+		return t.Weekday().String()
+	})
+
+	order := make(map[string]int)
+	for d := time.Monday; d <= time.Saturday; d++ {
+		order[d.String()] = int(d)
+	}
+	order[time.Sunday.String()] = 7
+
+	sort.Slice(buckets, func(i, j int) bool {
+		return order[buckets[i].Key] < order[buckets[j].Key]
+	})
+
+	return buckets
+}
+
+// Periods a time series can be bucketed by
+const (
+	PeriodWeek  = "week"
+	PeriodMonth = "month"
+)
+
+// PeriodStart returns when the UTC week, from Monday, or month holding t began
+func PeriodStart(t time.Time, period string) time.Time {
+	t = t.UTC()
+
+	if period == PeriodWeek {
+		day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		return day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+	}
+
+	return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+}
+
+// NextPeriod returns when the period beginning at start ends
+func NextPeriod(start time.Time, period string) time.Time {
+	if period == PeriodWeek {
+		return start.AddDate(0, 0, 7)
+	}
+
+	return start.AddDate(0, 1, 0)
+}
+
+// Periods returns when each period overlapping from to until began, in chronological order
+func Periods(from time.Time, until time.Time, period string) []time.Time {
+	var starts []time.Time
+
+	for start := PeriodStart(from, period); start.Before(until); start = NextPeriod(start, period) {
+		starts = append(starts, start)
+	}
+
+	return starts
+}
+
+// Series buckets the games played from from to until by period, keyed by the period's first day, e.g.
+// "2026-03-01", in chronological order. Every period gets a bucket, so that a chart shows the gaps where
+// no games were played. Games outside of the range or without time tags are skipped.
+func Series(results []acpl.GameACPL, period string, from time.Time, until time.Time) []Bucket {
+	grouped := GroupBy(results, func(r acpl.GameACPL) string {
+		t, ok := acpl.GameTime(r.Game)
+		if !ok || t.Before(from) || !t.Before(until) {
+			return ""
+		}
+		return PeriodStart(t, period).Format(time.DateOnly)
+	})
+
+	// keys are dates, so grouped is in chronological order too
+	periods := Periods(from, until, period)
+	series := make([]Bucket, 0, len(periods))
+
+	for _, start := range periods {
+		key := start.Format(time.DateOnly)
+
+		if len(grouped) > 0 && grouped[0].Key == key {
+			series = append(series, grouped[0])
+			grouped = grouped[1:]
+		} else {
+			series = append(series, Bucket{Key: key, InsufficientData: true})
+		}
+	}
+
+	return series
+}
+
+// Summary aggregates the user's play across games
+type Summary struct {
+	Games int `json:"games"`
+	// Aggregate is how AverageACPL was computed, see the Aggregate constants
+	Aggregate   string  `json:"aggregate"`
+	AverageACPL float64 `json:"averageAcpl"`
+	MedianACPL  float64 `json:"medianAcpl"`
+	// BlunderRate is the share of the player's counted moves that lost at least acpl.BlunderThreshold
+	BlunderRate float64 `json:"blunderRate"`
+	// Accuracy is the mean of the games' accuracy percentages
+	Accuracy float64 `json:"accuracy"`
+	// ExpectedPointsLost totals acpl.ExpectedPointsLost over the games
+	ExpectedPointsLost float64 `json:"expectedPointsLost"`
+	// White and Black average ACPL as AverageACPL does, over the games played with each colour. They are
+	// nil with fewer than Summarize's minGames games.
+	White *ColorSummary `json:"white,omitempty"`
+	Black *ColorSummary `json:"black,omitempty"`
+	// QueensOn and QueensOff average the loss of the player's moves made with queens on the board and
+	// without them, over all games. They are nil when fewer than minGames games had such moves, e.g. when
+	// queens were rarely traded.
+	QueensOn  *PhaseSummary `json:"queensOn,omitempty"`
+	QueensOff *PhaseSummary `json:"queensOff,omitempty"`
+	// Peers compares AverageACPL with players of the user's average rating; nil when no game has ratings
+	Peers *PeerComparison `json:"peers,omitempty"`
+}
+
+type ColorSummary struct {
+	Games       int     `json:"games"`
+	AverageACPL float64 `json:"averageAcpl"`
+}
+
+// PhaseSummary is the average loss of the moves made in one phase of the game, see Summary.QueensOn.
+// Games counts the games with at least one such move.
+type PhaseSummary struct {
+	Games int     `json:"games"`
+	Moves int     `json:"moves"`
+	ACPL  float64 `json:"acpl"`
+}
+
+// add counts the loss of one more move
+func (p *PhaseSummary) add(loss float64) {
+	p.ACPL = (p.ACPL*float64(p.Moves) + loss) / float64(p.Moves+1)
+	p.Moves++
+}
+
+// averageACPL averages the results' ACPL as aggregate says, or returns 0 when there are none
+func averageACPL(results []acpl.GameACPL, aggregate string) float64 {
+	total, totalLoss, counted := 0.0, 0.0, 0
+
+	for _, r := range results {
+		total += r.ACPL
+		totalLoss += r.TotalLoss
+		counted += r.Count
+	}
+
+	if aggregate == AggregateMoves && counted > 0 {
+		return totalLoss / float64(counted)
+	}
+	if len(results) == 0 {
+		return 0
+	}
+	return total / float64(len(results))
+}
+
+// Summarize aggregates results, leaving out the colours and phases with fewer than minGames games
+func Summarize(results []acpl.GameACPL, aggregate string, minGames int) Summary {
+	if aggregate != AggregateMoves {
+		aggregate = AggregateGames
+	}
+
+	summary := Summary{Games: len(results), Aggregate: aggregate}
+	if len(results) == 0 {
+		return summary
+	}
+
+	// a split without games has nothing to report
+	minGames = max(minGames, 1)
+
+	acpls := make([]float64, 0, len(results))
+	moves, blunders := 0, 0
+	var white, black []acpl.GameACPL
+	var queensOn, queensOff PhaseSummary
+
+	for _, r := range results {
+		acpls = append(acpls, r.ACPL)
+		summary.Accuracy += r.Accuracy
+		summary.ExpectedPointsLost += r.ExpectedPointsLost
+
+		if r.IsWhite {
+			white = append(white, r)
+		} else {
+			black = append(black, r)
+		}
+
+		positions := r.Game.Positions()
+		onMoves, offMoves := queensOn.Moves, queensOff.Moves
+
+		// the moves ACPL and GameACPL.Blunders count, so that options leaving moves out apply here too
+		for _, l := range r.Counted {
+			moves++
+			if l.Loss >= acpl.BlunderThreshold {
+				blunders++
+			}
+
+			if l.Ply < len(positions) && acpl.QueensOn(positions[l.Ply]) {
+				queensOn.add(l.Loss)
+			} else {
+				queensOff.add(l.Loss)
+			}
+		}
+
+		if queensOn.Moves > onMoves {
+			queensOn.Games++
+		}
+		if queensOff.Moves > offMoves {
+			queensOff.Games++
+		}
+	}
+
+	summary.AverageACPL = averageACPL(results, aggregate)
+
+	if len(white) >= minGames {
+		summary.White = &ColorSummary{Games: len(white), AverageACPL: averageACPL(white, aggregate)}
+	}
+	if len(black) >= minGames {
+		summary.Black = &ColorSummary{Games: len(black), AverageACPL: averageACPL(black, aggregate)}
+	}
+	if queensOn.Games >= minGames {
+		summary.QueensOn = &queensOn
+	}
+	if queensOff.Games >= minGames {
+		summary.QueensOff = &queensOff
+	}
+	summary.Accuracy /= float64(len(results))
+	summary.MedianACPL = Median(acpls)
+
+	if moves > 0 {
+		summary.BlunderRate = float64(blunders) / float64(moves)
+	}
+
+	if peers, ok := ComparePeers(results, summary.AverageACPL); ok {
+		summary.Peers = &peers
+	}
+
+	return summary
+}
+
+// peerBand is the ACPL typical of players rated MinRating and above, up to the next band
+type peerBand struct {
+	MinRating    int
+	ExpectedACPL float64
+}
+
+// peerBands are rough figures for analysed Lichess blitz and rapid games, in ascending order. They
+// are not from a study: they follow commonly quoted rules of thumb, ACPL falling by about 5 per
+// 200 rating points, and are only meant to say whether a user is broadly ahead of or behind peers.
+var peerBands = []peerBand{
+	{0, 90},
+	{1000, 75},
+	{1200, 65},
+	{1400, 55},
+	{1600, 47},
+	{1800, 40},
+	{2000, 33},
+	{2200, 27},
+	{2400, 22},
+}
+
+// peerTolerance is how far, in ACPL, a user may be from the expected value and still play as expected
+const peerTolerance = 5.0
+
+// Verdicts of a PeerComparison
+const (
+	PeersBetter   = "better"
+	PeersExpected = "expected"
+	PeersWorse    = "worse"
+)
+
+// PeerComparison is how the user's ACPL compares with what is typical at their rating
+type PeerComparison struct {
+	Rating       int     `json:"rating"`
+	ExpectedACPL float64 `json:"expectedAcpl"`
+	Verdict      string  `json:"verdict"`
+}
+
+// ExpectedACPL returns the typical ACPL of players with rating
+func ExpectedACPL(rating int) float64 {
+	expected := peerBands[0].ExpectedACPL
+	for _, b := range peerBands {
+		if rating >= b.MinRating {
+			expected = b.ExpectedACPL
+		}
+	}
+	return expected
+}
+
+// ComparePeers compares averageACPL with what is expected at the player's average rating over results.
+// It is not ok when no game has both ratings.
+func ComparePeers(results []acpl.GameACPL, averageACPL float64) (PeerComparison, bool) {
+	total, rated := 0, 0
+
+	for _, r := range results {
+		if player, _, ok := acpl.Ratings(r.Game, r.IsWhite); ok {
+			total += player
+			rated++
+		}
+	}
+
+	if rated == 0 {
+		return PeerComparison{}, false
+	}
+
+	rating := int(math.Round(float64(total) / float64(rated)))
+	comparison := PeerComparison{Rating: rating, ExpectedACPL: ExpectedACPL(rating), Verdict: PeersExpected}
+
+	switch {
+	case averageACPL < comparison.ExpectedACPL-peerTolerance:
+		comparison.Verdict = PeersBetter
+	case averageACPL > comparison.ExpectedACPL+peerTolerance:
+		comparison.Verdict = PeersWorse
+	}
+
+	return comparison, true
+}
+
+func Median(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return (sorted[mid-1] + sorted[mid]) / 2
+	}
+	return sorted[mid]
+}
+
+// Worst returns the bucket with the highest average ACPL, leaving out those with insufficient data
+func Worst(buckets []Bucket) (Bucket, bool) {
+	var worst Bucket
+	found := false
+
+	for _, b := range buckets {
+		if !b.InsufficientData && (!found || b.AverageACPL > worst.AverageACPL) {
+			worst, found = b, true
+		}
+	}
+
+	return worst, found
+}
+
+// Comparison is how a player's accuracy changed from a previous set of games to a recent one
+type Comparison struct {
+	Previous Summary `json:"previous"`
+	Recent   Summary `json:"recent"`
+	// Comparable is false when either set has fewer games than required, in which case the changes are zero
+	Comparable bool `json:"comparable"`
+	// ACPLChange and BlunderRateChange are recent minus previous, so negative means improvement
+	ACPLChange        float64 `json:"acplChange"`
+	BlunderRateChange float64 `json:"blunderRateChange"`
+}
+
+// Compare diffs two summaries, requiring at least minGames games in each
+func Compare(previous Summary, recent Summary, minGames int) Comparison {
+	c := Comparison{Previous: previous, Recent: recent}
+
+	if previous.Games < minGames || recent.Games < minGames || previous.Games == 0 || recent.Games == 0 {
+		return c
+	}
+
+	c.Comparable = true
+	c.ACPLChange = recent.AverageACPL - previous.AverageACPL
+	c.BlunderRateChange = recent.BlunderRate - previous.BlunderRate
+
+	return c
+}
+
+// lossEdges are the lower bounds, in centipawns, of the LossHistogram bins
+var lossEdges = []float64{0, 10, 25, 50, 100, 200, 300}
+
+// Bin counts the moves whose loss is at least From and below To. The last bin has no upper bound and
+// omits To.
+type Bin struct {
+	From  float64  `json:"from"`
+	To    *float64 `json:"to,omitempty"`
+	Moves int      `json:"moves"`
+}
+
+// LossHistogram bins the loss of every evaluated move across results. All bins are returned, even empty.
+func LossHistogram(results []acpl.GameACPL) []Bin {
+	bins := make([]Bin, len(lossEdges))
+	for i, from := range lossEdges {
+		bins[i].From = from
+		if i+1 < len(lossEdges) {
+			bins[i].To = &lossEdges[i+1]
+		}
+	}
+
+	for _, r := range results {
+		for _, l := range r.Losses {
+			i := sort.SearchFloat64s(lossEdges, l.Loss)
+			// SearchFloat64s finds the first edge at or above the loss, which starts the next bin unless equal
+			if i == len(lossEdges) || lossEdges[i] != l.Loss {
+				i--
+			}
+			bins[i].Moves++
+		}
+	}
+
+	return bins
+}
@@ -0,0 +1,121 @@
+package stats
+
+import (
+	"fmt"
+	"macg/app/acpl"
+	"reflect"
+	"testing"
+
+	"github.com/notnil/chess"
+)
+
+// gameACPL is a result whose losses are all counted, on plies made from the game's first position
+func gameACPL(game *chess.Game, isWhite bool, accuracy float64, losses ...float64) acpl.GameACPL {
+	r := acpl.GameACPL{Game: game, IsWhite: isWhite, Accuracy: accuracy, Count: len(losses)}
+
+	for _, loss := range losses {
+		r.Counted = append(r.Counted, acpl.PlyLoss{Loss: loss})
+		r.TotalLoss += loss
+	}
+	r.ACPL = r.TotalLoss / float64(r.Count)
+	r.Losses = r.Counted
+
+	return r
+}
+
+func TestSummarize(t *testing.T) {
+	queens := chess.NewGame()
+
+	fen, err := chess.FEN("4k3/8/8/8/8/8/8/4K3 w - - 0 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	endgame := chess.NewGame(fen)
+
+	blundered := gameACPL(endgame, true, 75, 40)
+	// a blunder the options left out of ACPL is not counted either
+	blundered.Losses = append(blundered.Losses, acpl.PlyLoss{Loss: 500})
+
+	results := []acpl.GameACPL{
+		gameACPL(queens, true, 90, 0, 20),
+		gameACPL(queens, false, 60, 300, 0, 0, 100),
+		blundered,
+	}
+
+	tests := []struct {
+		name      string
+		results   []acpl.GameACPL
+		aggregate string
+		minGames  int
+		want      Summary
+	}{
+		{
+			name:      "games",
+			results:   results,
+			aggregate: AggregateGames,
+			minGames:  1,
+			want: Summary{
+				Games: 3, Aggregate: AggregateGames, AverageACPL: 50, MedianACPL: 40, BlunderRate: 1.0 / 7, Accuracy: 75,
+				White:     &ColorSummary{Games: 2, AverageACPL: 25},
+				Black:     &ColorSummary{Games: 1, AverageACPL: 100},
+				QueensOn:  &PhaseSummary{Games: 2, Moves: 6, ACPL: 70},
+				QueensOff: &PhaseSummary{Games: 1, Moves: 1, ACPL: 40},
+			},
+		},
+		{
+			name:      "moves",
+			results:   results,
+			aggregate: AggregateMoves,
+			minGames:  1,
+			want: Summary{
+				Games: 3, Aggregate: AggregateMoves, AverageACPL: 460.0 / 7, MedianACPL: 40, BlunderRate: 1.0 / 7, Accuracy: 75,
+				White:     &ColorSummary{Games: 2, AverageACPL: 20},
+				Black:     &ColorSummary{Games: 1, AverageACPL: 100},
+				QueensOn:  &PhaseSummary{Games: 2, Moves: 6, ACPL: 70},
+				QueensOff: &PhaseSummary{Games: 1, Moves: 1, ACPL: 40},
+			},
+		},
+		{
+			name:      "too few games for some splits",
+			results:   results,
+			aggregate: AggregateGames,
+			minGames:  2,
+			want: Summary{
+				Games: 3, Aggregate: AggregateGames, AverageACPL: 50, MedianACPL: 40, BlunderRate: 1.0 / 7, Accuracy: 75,
+				White:    &ColorSummary{Games: 2, AverageACPL: 25},
+				QueensOn: &PhaseSummary{Games: 2, Moves: 6, ACPL: 70},
+			},
+		},
+		{
+			name:      "unknown aggregate",
+			results:   results[:1],
+			aggregate: "plies",
+			want: Summary{
+				Games: 1, Aggregate: AggregateGames, AverageACPL: 10, MedianACPL: 10, Accuracy: 90,
+				White:    &ColorSummary{Games: 1, AverageACPL: 10},
+				QueensOn: &PhaseSummary{Games: 1, Moves: 2, ACPL: 10},
+			},
+		},
+		{
+			name:      "no games",
+			aggregate: AggregateMoves,
+			minGames:  1,
+			want:      Summary{Aggregate: AggregateMoves},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Summarize(tt.results, tt.aggregate, tt.minGames)
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Summarize() = %s, want %s", describe(got), describe(tt.want))
+			}
+		})
+	}
+}
+
+// describe prints a summary with its splits rather than their addresses
+func describe(s Summary) string {
+	return fmt.Sprintf("%+v white=%+v black=%+v queensOn=%+v queensOff=%+v", s, s.White, s.Black, s.QueensOn, s.QueensOff)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"macg/app/cache"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// TimeControlGames is how many games a user has played in a time control
+type TimeControlGames struct {
+	TimeControl string `json:"timeControl"`
+	Games       int    `json:"games"`
+}
+
+var timeControlsCache = cache.NewCache[[]TimeControlGames](envDuration("TIME_CONTROLS_CACHE_TTL", 5*time.Minute), envInt("TIME_CONTROLS_CACHE_MAX_ENTRIES", 1000))
+
+// fetchTimeControls reads the user's game counts from their Lichess profile, most played first.
+// Time controls the user has not played are left out.
+func fetchTimeControls(ctx context.Context, username string) ([]TimeControlGames, error) {
+	body, err := fetchLichess(ctx, lichessURL+"/api/user/"+username)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var user struct {
+		Perfs map[string]struct {
+			Games int `json:"games"`
+		} `json:"perfs"`
+	}
+
+	if err := json.Unmarshal(body, &user); err != nil {
+		return nil, err
+	}
+
+	counts := []TimeControlGames{}
+
+	// perfs also hold variants and puzzles, which cannot be searched
+	for name, perf := range user.Perfs {
+		if validTimeControls[name] && name != "all" && perf.Games > 0 {
+			counts = append(counts, TimeControlGames{TimeControl: name, Games: perf.Games})
+		}
+	}
+
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Games != counts[j].Games {
+			return counts[i].Games > counts[j].Games
+		}
+		return counts[i].TimeControl < counts[j].TimeControl
+	})
+
+	return counts, nil
+}
+
+// cachedTimeControls returns the user's game counts, fetching them unless they are cached
+func cachedTimeControls(ctx context.Context, username string) ([]TimeControlGames, error) {
+	key := strings.ToLower(username)
+
+	if counts, _, ok := timeControlsCache.Get(key); ok {
+		return counts, nil
+	}
+
+	counts, err := fetchTimeControls(ctx, username)
+
+	if err != nil {
+		return nil, err
+	}
+
+	timeControlsCache.Set(key, counts)
+	return counts, nil
+}
+
+// handleTimeControls lists the time controls the user plays with approximate game counts
+func handleTimeControls(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Handling time controls for %s", r.RemoteAddr)
+
+	username := r.FormValue("username")
+	if !usernamePattern.MatchString(username) {
+		writeJSONError(w, http.StatusBadRequest, "invalid username")
+		return
+	}
+
+	counts, err := cachedTimeControls(r.Context(), username)
+
+	if err != nil {
+		log.Printf("Error retrieving time controls for %s: %v", r.RemoteAddr, err)
+		writeJSONError(w, errorStatus(err), friendlyError(err, "User not found."))
+		return
+	}
+
+	setCacheHeaders(w)
+	writeJSON(w, counts)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"macg/app/acpl"
+	"regexp"
+	"strings"
+)
+
+var tournamentIdPattern = regexp.MustCompile(`^[a-zA-Z0-9]{8}$`)
+
+// parseTournament accepts an arena or Swiss tournament URL, or a bare ID which is assumed to be an arena
+func parseTournament(s string) (kind string, id string, ok bool) {
+	s = strings.TrimSpace(s)
+	s = strings.TrimPrefix(s, "https://")
+	s = strings.TrimPrefix(s, "http://")
+	s = strings.TrimPrefix(s, "www.")
+	s = strings.TrimPrefix(s, "lichess.org/")
+
+	kind = "tournament"
+	if rest, found := strings.CutPrefix(s, "swiss/"); found {
+		kind, s = "swiss", rest
+	} else {
+		s = strings.TrimPrefix(s, "tournament/")
+	}
+
+	if i := strings.IndexAny(s, "/?#"); i >= 0 {
+		s = s[:i]
+	}
+
+	return kind, s, tournamentIdPattern.MatchString(s)
+}
+
+// retrieveTournamentResults ranks the games username played in an arena or Swiss tournament
+func retrieveTournamentResults(ctx context.Context, kind string, id string, username string, opts acpl.Options) ([]acpl.GameACPL, error) {
+	key := kind + "|" + id + "|" + strings.ToLower(username)
+
+	return rankCached(ctx, key, username, opts, func(ctx context.Context) ([]byte, error) {
+		return fetchLichess(ctx, lichessURL+"/api/"+kind+"/"+id+"/games?player="+username+"&tags=true&clocks=true&evals=true&opening=true")
+	})
+}
+
+// retrieveTournamentField ranks every player of an arena or Swiss tournament by their ACPL across it.
+// The tournament's games are cached, and fetched at most once at a time, as if it were a user.
+func retrieveTournamentField(ctx context.Context, kind string, id string, opts acpl.Options) ([]acpl.Standing, error) {
+	pgn, _, err := cachedPGN(ctx, kind+"|"+id, kind+" "+id, func(ctx context.Context) ([]byte, error) {
+		return fetchLichess(ctx, lichessURL+"/api/"+kind+"/"+id+"/games?tags=true&clocks=true&evals=true&opening=true")
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return acpl.Leaderboard(ctx, bytes.NewReader(pgn), opts)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"log"
+	"macg/app/acpl"
+	"macg/app/stats"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var defaultTrendDays = 180
+
+// maxTrendPeriods caps the weeks or months of a trend, each of which is fetched separately
+var maxTrendPeriods = envInt("MAX_TREND_PERIODS", 52)
+
+// retrieveTrend ranks the search's games played from from to until. Each period is fetched separately so
+// that a busy one does not crowd the others out of maxGames, and the periods are cached together.
+func (s Search) retrieveTrend(ctx context.Context, from time.Time, until time.Time, period string) ([]acpl.GameACPL, error) {
+	key := "trend|" + gamesCacheKey(s.Username, s.TimeControl, s.RatedOnly, from) + "|" + strconv.FormatInt(until.UnixMilli(), 10) + "|" + period
+
+	pgn, _, err := cachedPGN(ctx, key, s.Username, func(ctx context.Context) ([]byte, error) {
+		var pgn []byte
+
+		for _, start := range stats.Periods(from, until, period) {
+			windowPGN, err := fetchGames(ctx, s.Username, s.TimeControl, s.RatedOnly, later(start, from), earlier(stats.NextPeriod(start, period), until))
+
+			if err != nil {
+				return nil, err
+			}
+
+			pgn = append(append(pgn, windowPGN...), "\n\n\n"...)
+		}
+
+		return pgn, nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	results, _, err := rankPGN(ctx, pgn, s.Username, s.Options)
+	return results, err
+}
+
+// later returns the later of a and b
+func later(a time.Time, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// earlier returns the earlier of a and b
+func earlier(a time.Time, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+// parseTrendDate reads a date such as 2026-01-31 from the form, returning the zero time when it is not set
+func parseTrendDate(r *http.Request, name string) (time.Time, bool) {
+	v := r.FormValue(name)
+	if v == "" {
+		return time.Time{}, true
+	}
+
+	t, err := time.Parse(time.DateOnly, v)
+	return t, err == nil
+}
+
+// handleTrend returns the user's average ACPL week by week or month by month, from the last days (180 by
+// default) or a from date to today or a to date, for a trend chart
+func handleTrend(w http.ResponseWriter, r *http.Request) {
+	log.Printf("Handling trend for %s", r.RemoteAddr)
+
+	search, ok := parseSearch(w, r)
+	if !ok {
+		return
+	}
+
+	period := r.FormValue("by")
+	if period == "" {
+		period = stats.PeriodMonth
+	}
+
+	if period != stats.PeriodWeek && period != stats.PeriodMonth {
+		writeJSONError(w, http.StatusBadRequest, "by must be week or month")
+		return
+	}
+
+	now := time.Now()
+	from, until := search.Since, now.Truncate(time.Hour)
+	if from.IsZero() {
+		from = lastDaysSince(now, defaultTrendDays)
+	}
+
+	fromDate, okFrom := parseTrendDate(r, "from")
+	toDate, okTo := parseTrendDate(r, "to")
+
+	if !okFrom || !okTo {
+		writeJSONError(w, http.StatusBadRequest, "from and to must be dates such as 2026-01-31")
+		return
+	}
+
+	if !fromDate.IsZero() {
+		from = fromDate
+	}
+	if !toDate.IsZero() {
+		until = toDate.AddDate(0, 0, 1) // to is included
+	}
+
+	if !from.Before(until) {
+		writeJSONError(w, http.StatusBadRequest, "from must be before to")
+		return
+	}
+
+	if periods := len(stats.Periods(from, until, period)); periods > maxTrendPeriods {
+		writeJSONError(w, http.StatusBadRequest, "a trend can span at most "+strconv.Itoa(maxTrendPeriods)+" "+period+"s")
+		return
+	}
+
+	results, err := search.retrieveTrend(r.Context(), from, until, period)
+
+	if err != nil {
+		log.Printf("Error retrieving results for %s: %v", r.RemoteAddr, err)
+		writeJSONError(w, errorStatus(err), friendlyError(err, "User not found."))
+		return
+	}
+
+	setCacheHeaders(w)
+	writeJSON(w, stats.MinGames(stats.Series(results, period, from, until), minSampleGames))
+}